@@ -28,6 +28,14 @@ import (
 const (
 	// Number of codehash->size associations to keep.
 	codeSizeCacheSize = 100000
+
+	// Number of contract code blobs to keep.
+	codeCacheSize = 10000
+
+	// Number of codehash->size associations and code blobs to keep per MB of
+	// trie node cache allowance, adding about a tenth to the memory used.
+	codeSizesPerCacheMB = 1000
+	codesPerCacheMB     = 16
 )
 
 // Database wraps access to tries and contract code.
@@ -105,20 +113,50 @@ func NewDatabase(db ethdb.Database) Database {
 
 // NewDatabaseWithCache creates a backing store for state. The returned database
 // is safe for concurrent use and retains a lot of collapsed RLP trie nodes in a
-// large memory cache.
+// large memory cache. The contract code caches are sized in proportion to the
+// cache allowance (in MB), or get the defaults if it is zero.
 func NewDatabaseWithCache(db ethdb.Database, cache int) Database {
-	csc, _ := lru.New(codeSizeCacheSize)
-	return &cachingDB{
-		db:            trie.NewDatabaseWithCache(db, cache),
-		codeSizeCache: csc,
+	code, sizes := codeCacheSize, codeSizeCacheSize
+	if cache > 0 {
+		code, sizes = cache*codesPerCacheMB, cache*codeSizesPerCacheMB
 	}
+	return NewDatabaseWithCodeCache(db, cache, code, sizes)
+}
+
+// NewDatabaseWithCodeCache is like NewDatabaseWithCache, but explicitly sets the
+// number of contract code blobs and codehash->size associations to retain, see
+// SetCodeCacheSizes.
+func NewDatabaseWithCodeCache(db ethdb.Database, cache int, code, sizes int) Database {
+	cdb := &cachingDB{db: trie.NewDatabaseWithCache(db, cache)}
+	cdb.SetCodeCacheSizes(code, sizes)
+	return cdb
 }
 
 type cachingDB struct {
 	db            *trie.Database
+	codeCache     *lru.Cache
 	codeSizeCache *lru.Cache
 }
 
+// SetCodeCacheSizes replaces the contract code and code size caches with empty
+// ones retaining up to code blobs and sizes associations, non-positive values
+// selecting the defaults. A code blob takes a few KB on average (24KB at most),
+// a size association in the order of a hundred bytes, so the defaults of 10000
+// and 100000 amount to some tens of MB and about 10MB respectively.
+//
+// The caches are swapped without synchronization, so this must not be called
+// while the database is in use.
+func (db *cachingDB) SetCodeCacheSizes(code, sizes int) {
+	if code <= 0 {
+		code = codeCacheSize
+	}
+	if sizes <= 0 {
+		sizes = codeSizeCacheSize
+	}
+	db.codeCache, _ = lru.New(code)
+	db.codeSizeCache, _ = lru.New(sizes)
+}
+
 // OpenTrie opens the main account trie at a specific root hash.
 func (db *cachingDB) OpenTrie(root common.Hash) (Trie, error) {
 	return trie.NewSecure(root, db.db)
@@ -126,7 +164,7 @@ func (db *cachingDB) OpenTrie(root common.Hash) (Trie, error) {
 
 // OpenStorageTrie opens the storage trie of an account.
 func (db *cachingDB) OpenStorageTrie(addrHash, root common.Hash) (Trie, error) {
-	return trie.NewSecure(root, db.db)
+	return trie.NewSecureWithPrefix(root, addrHash[:], db.db)
 }
 
 // CopyTrie returns an independent copy of the given trie.
@@ -141,8 +179,12 @@ func (db *cachingDB) CopyTrie(t Trie) Trie {
 
 // ContractCode retrieves a particular contract's code.
 func (db *cachingDB) ContractCode(addrHash, codeHash common.Hash) ([]byte, error) {
+	if cached, ok := db.codeCache.Get(codeHash); ok {
+		return cached.([]byte), nil
+	}
 	code, err := db.db.Node(codeHash)
 	if err == nil {
+		db.codeCache.Add(codeHash, code)
 		db.codeSizeCache.Add(codeHash, len(code))
 	}
 	return code, err
@@ -17,8 +17,10 @@
 package state
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -79,3 +81,97 @@ func (self *StateDB) Dump() []byte {
 
 	return json
 }
+
+// ExportAccounts writes every account in the state trie to w as a line of
+// hex encoded "addrHash,account" pairs, with the account in its consensus RLP
+// encoding. Lines are emitted in ascending address hash order.
+func (self *StateDB) ExportAccounts(w io.Writer) error {
+	it := trie.NewIterator(self.trie.NodeIterator(nil))
+	for it.Next() {
+		if _, err := fmt.Fprintf(w, "%x,%x\n", it.Key, it.Value); err != nil {
+			return err
+		}
+	}
+	return it.Err
+}
+
+// Equal compares the account tries of two states, descending into the storage
+// tries of accounts that differ, and reports a description of the first account
+// or storage slot found to be different. Subtries with identical hashes on both
+// sides are skipped. Both states must be committed, since storage tries are
+// opened from the trie database.
+func (self *StateDB) Equal(other *StateDB) (bool, string, error) {
+	if self.trie.Hash() == other.trie.Hash() {
+		return true, "", nil
+	}
+	key, a, b, err := firstDiff(self.trie, other.trie)
+	if err != nil {
+		return false, "", err
+	}
+	if a == nil || b == nil {
+		return false, fmt.Sprintf("account %x only present on one side", key), nil
+	}
+	var accA, accB Account
+	if err := rlp.DecodeBytes(a, &accA); err != nil {
+		return false, "", err
+	}
+	if err := rlp.DecodeBytes(b, &accB); err != nil {
+		return false, "", err
+	}
+	if accA.Root == accB.Root {
+		return false, fmt.Sprintf("account %x differs", key), nil
+	}
+	addrHash := common.BytesToHash(key)
+	trA, err := self.db.OpenStorageTrie(addrHash, accA.Root)
+	if err != nil {
+		return false, "", err
+	}
+	trB, err := other.db.OpenStorageTrie(addrHash, accB.Root)
+	if err != nil {
+		return false, "", err
+	}
+	slot, _, _, err := firstDiff(trA, trB)
+	if err != nil {
+		return false, "", err
+	}
+	return false, fmt.Sprintf("account %x slot %x differs", key, slot), nil
+}
+
+// firstDiff returns the first key whose presence or value differs between two
+// tries, along with its values on both sides (nil if missing). If the tries are
+// equal, a nil key is returned. Only the parts of the tries that differ are
+// walked.
+func firstDiff(a, b Trie) ([]byte, []byte, []byte, error) {
+	onlyA, _ := trie.NewDifferenceIterator(b.NodeIterator(nil), a.NodeIterator(nil))
+	keyA, valA, err := firstLeaf(onlyA)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	onlyB, _ := trie.NewDifferenceIterator(a.NodeIterator(nil), b.NodeIterator(nil))
+	keyB, valB, err := firstLeaf(onlyB)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// A key changed on both sides shows up in both differences, a key present on
+	// one side only precedes the first difference of the other
+	switch {
+	case keyA == nil && keyB == nil:
+		return nil, nil, nil, nil
+	case keyB == nil || (keyA != nil && bytes.Compare(keyA, keyB) < 0):
+		return keyA, valA, nil, nil
+	case keyA == nil || bytes.Compare(keyA, keyB) > 0:
+		return keyB, nil, valB, nil
+	default:
+		return keyA, valA, valB, nil
+	}
+}
+
+// firstLeaf returns the key and value of the first leaf of a node iterator.
+func firstLeaf(it trie.NodeIterator) ([]byte, []byte, error) {
+	for it.Next(true) {
+		if it.Leaf() {
+			return common.CopyBytes(it.LeafKey()), common.CopyBytes(it.LeafBlob()), nil
+		}
+	}
+	return nil, nil, it.Error()
+}
@@ -112,6 +112,11 @@ func newObject(db *StateDB, address common.Address, data Account) *stateObject {
 	if data.CodeHash == nil {
 		data.CodeHash = emptyCodeHash
 	}
+	// An empty storage trie is always represented by emptyRoot, never the zero
+	// hash, since the two are treated differently downstream.
+	if data.Root == (common.Hash{}) {
+		data.Root = emptyRoot
+	}
 	return &stateObject{
 		db:            db,
 		address:       address,
@@ -17,14 +17,18 @@
 package state
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
 	"math/big"
+	"strings"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
 	checker "gopkg.in/check.v1"
 )
 
@@ -87,6 +91,48 @@ func (s *StateSuite) TestDump(c *checker.C) {
 	}
 }
 
+func (s *StateSuite) TestExportAccounts(c *checker.C) {
+	// generate a few entries and commit them
+	for i, addr := range []common.Address{toAddr([]byte{0x01}), toAddr([]byte{0x01, 0x02}), toAddr([]byte{0x02})} {
+		s.state.AddBalance(addr, big.NewInt(int64(i+1)))
+	}
+	s.state.Commit(false)
+
+	var buf bytes.Buffer
+	c.Assert(s.state.ExportAccounts(&buf), checker.IsNil)
+
+	// re-parse the export and check it against the raw dump
+	dump := s.state.RawDump()
+	exported := make(map[string]Account)
+
+	var prev []byte
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		c.Assert(fields, checker.HasLen, 2)
+
+		hash, blob := common.FromHex(fields[0]), common.FromHex(fields[1])
+		if prev != nil && bytes.Compare(prev, hash) >= 0 {
+			c.Errorf("export not sorted: %x after %x", hash, prev)
+		}
+		prev = hash
+
+		var data Account
+		c.Assert(rlp.DecodeBytes(blob, &data), checker.IsNil)
+		exported[common.Bytes2Hex(s.state.trie.GetKey(hash))] = data
+	}
+	c.Assert(exported, checker.HasLen, len(dump.Accounts))
+	for addr, account := range dump.Accounts {
+		data, ok := exported[addr]
+		if !ok {
+			c.Errorf("account %s missing from export", addr)
+			continue
+		}
+		c.Assert(data.Balance.String(), checker.Equals, account.Balance)
+		c.Assert(common.Bytes2Hex(data.Root[:]), checker.Equals, account.Root)
+	}
+}
+
 func (s *StateSuite) SetUpTest(c *checker.C) {
 	s.db = rawdb.NewMemoryDatabase()
 	s.state, _ = New(common.Hash{}, NewDatabase(s.db))
@@ -139,6 +185,60 @@ func (s *StateSuite) TestSnapshotEmpty(c *checker.C) {
 	s.state.RevertToSnapshot(s.state.Snapshot())
 }
 
+func TestStateEqual(t *testing.T) {
+	build := func() *StateDB {
+		state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()))
+		for i := byte(0); i < 16; i++ {
+			addr := toAddr([]byte{i})
+			state.AddBalance(addr, big.NewInt(int64(i)))
+			state.SetState(addr, common.BytesToHash([]byte{i}), common.BytesToHash([]byte{i, i}))
+		}
+		root, _ := state.Commit(false)
+		state, _ = New(root, state.Database())
+		return state
+	}
+	a, b := build(), build()
+	if equal, diff, err := a.Equal(b); err != nil || !equal {
+		t.Fatalf("identical states reported different: %s (err %v)", diff, err)
+	}
+	addr, slot := toAddr([]byte{7}), common.BytesToHash([]byte{0xff})
+	b.SetState(addr, slot, common.BytesToHash([]byte{1}))
+	b.Commit(false)
+
+	equal, diff, err := a.Equal(b)
+	if err != nil {
+		t.Fatalf("failed to compare states: %v", err)
+	}
+	if equal {
+		t.Fatalf("different states reported equal")
+	}
+	want := fmt.Sprintf("account %x slot %x differs", crypto.Keccak256(addr[:]), crypto.Keccak256(slot[:]))
+	if diff != want {
+		t.Errorf("diff mismatch: have %q, want %q", diff, want)
+	}
+	// A state with missing trie nodes must fail the comparison, not differ
+	diskdb := rawdb.NewMemoryDatabase()
+	b, _ = New(common.Hash{}, NewDatabase(diskdb))
+	b.AddBalance(toAddr([]byte{0}), big.NewInt(1))
+	b.AddBalance(toAddr([]byte{1}), big.NewInt(1))
+	root, _ := b.Commit(false)
+	b.Database().TrieDB().Commit(root, false)
+
+	var nodes [][]byte
+	for it := diskdb.NewIterator(); it.Next(); {
+		if len(it.Key()) == common.HashLength && !bytes.Equal(it.Key(), root[:]) {
+			nodes = append(nodes, common.CopyBytes(it.Key()))
+		}
+	}
+	for _, node := range nodes {
+		diskdb.Delete(node)
+	}
+	b, _ = New(root, NewDatabase(diskdb))
+	if _, diff, err := a.Equal(b); err == nil {
+		t.Errorf("missing node not reported, diff %q", diff)
+	}
+}
+
 // use testing instead of checker because checker does not support
 // printing/logging in tests (-check.vv does not work)
 func TestSnapshot2(t *testing.T) {
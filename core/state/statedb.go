@@ -27,6 +27,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -53,6 +54,20 @@ func (n *proofList) Put(key []byte, value []byte) error {
 	return nil
 }
 
+// proofSet is a proof node collector which drops duplicate nodes.
+type proofSet struct {
+	nodes [][]byte
+	seen  map[string]struct{}
+}
+
+func (n *proofSet) Put(key []byte, value []byte) error {
+	if _, ok := n.seen[string(key)]; !ok {
+		n.seen[string(key)] = struct{}{}
+		n.nodes = append(n.nodes, value)
+	}
+	return nil
+}
+
 // StateDBs within the ethereum protocol are used to store anything
 // within the merkle trie. StateDBs take care of caching and storing
 // nested states. It's the general query interface to retrieve:
@@ -291,6 +306,74 @@ func (self *StateDB) GetStorageProof(a common.Address, key common.Hash) ([][]byt
 	return [][]byte(proof), err
 }
 
+// GetStorageSlotsProof returns a single proof for multiple storage slots of the
+// given account. Nodes shared by the paths of several slots are only included
+// once, in the order they were first encountered.
+func (self *StateDB) GetStorageSlotsProof(a common.Address, slots []common.Hash) ([][]byte, error) {
+	trie := self.StorageTrie(a)
+	if trie == nil {
+		return nil, errors.New("storage trie for requested address does not exist")
+	}
+	proof := &proofSet{seen: make(map[string]struct{})}
+	for _, slot := range slots {
+		if err := trie.Prove(crypto.Keccak256(slot.Bytes()), 0, proof); err != nil {
+			return nil, err
+		}
+	}
+	return proof.nodes, nil
+}
+
+// VerifyContractProof checks an account proof against the state root and a
+// storage proof for the given slots against the proven account's storage root,
+// as produced by GetProof and GetStorageSlotsProof. It returns the account and
+// the value of every slot, nil for empty ones. A proof of the account's absence
+// yields a nil account.
+func VerifyContractProof(root common.Hash, addr common.Address, accountProof, storageProof [][]byte, slots []common.Hash) (*Account, map[common.Hash][]byte, error) {
+	enc, _, err := trie.VerifyProof(root, crypto.Keccak256(addr[:]), newProofDB(accountProof))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid account proof: %v", err)
+	}
+	if enc == nil {
+		return nil, nil, nil
+	}
+	account := new(Account)
+	if err := rlp.DecodeBytes(enc, account); err != nil {
+		return nil, nil, fmt.Errorf("invalid account: %v", err)
+	}
+	storage := make(map[common.Hash][]byte, len(slots))
+	if account.Root == emptyRoot {
+		// Empty storage has no nodes to prove, every slot is empty
+		for _, slot := range slots {
+			storage[slot] = nil
+		}
+		return account, storage, nil
+	}
+	proofDB := newProofDB(storageProof)
+	for _, slot := range slots {
+		enc, _, err := trie.VerifyProof(account.Root, crypto.Keccak256(slot[:]), proofDB)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid storage proof for slot %x: %v", slot, err)
+		}
+		var value []byte
+		if enc != nil {
+			if _, value, _, err = rlp.Split(enc); err != nil {
+				return nil, nil, fmt.Errorf("invalid storage value for slot %x: %v", slot, err)
+			}
+		}
+		storage[slot] = value
+	}
+	return account, storage, nil
+}
+
+// newProofDB loads a list of proof nodes into a database keyed by their hash.
+func newProofDB(proof [][]byte) *memorydb.Database {
+	db := memorydb.New()
+	for _, node := range proof {
+		db.Put(crypto.Keccak256(node), node)
+	}
+	return db
+}
+
 // GetCommittedState retrieves a value from the given account's committed storage trie.
 func (self *StateDB) GetCommittedState(addr common.Address, hash common.Hash) common.Hash {
 	stateObject := self.getStateObject(addr)
@@ -517,6 +600,39 @@ func (db *StateDB) ForEachStorage(addr common.Address, cb func(key, value common
 	}
 }
 
+// IterateStorage calls cb for the storage slots of the given account held in
+// its storage trie, in ascending order of the hashed slot keys, starting at
+// the hashed key start. Slots are reported by their preimage where known; for
+// the others hashed is set and key is the hashed slot key. Values are RLP
+// decoded. Iteration stops at the first error returned by cb, which is passed
+// on.
+//
+// Like GetState, accounts that self-destructed or were deleted have no storage.
+// Changes not yet flushed into the storage trie by Finalise, IntermediateRoot
+// or Commit are not visible.
+func (self *StateDB) IterateStorage(addr common.Address, start common.Hash, cb func(key common.Hash, hashed bool, value []byte) error) error {
+	so := self.getStateObject(addr)
+	if so == nil || so.suicided {
+		return nil
+	}
+	tr := so.getTrie(self.db)
+	it := trie.NewIterator(tr.NodeIterator(start[:]))
+	for it.Next() {
+		key, hashed := common.BytesToHash(it.Key), true
+		if preimage := tr.GetKey(it.Key); preimage != nil {
+			key, hashed = common.BytesToHash(preimage), false
+		}
+		_, value, _, err := rlp.Split(it.Value)
+		if err != nil {
+			return err
+		}
+		if err := cb(key, hashed, value); err != nil {
+			return err
+		}
+	}
+	return it.Err
+}
+
 // Copy creates a deep, independent copy of the state.
 // Snapshots of the copied state cannot be applied to the copy.
 func (self *StateDB) Copy() *StateDB {
@@ -19,6 +19,7 @@ package state
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
@@ -33,6 +34,10 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 // Tests that updating a state trie does not leak any database writes prior to
@@ -449,3 +454,260 @@ func TestCopyOfCopy(t *testing.T) {
 		t.Fatalf("2nd copy fail, expected 42, got %v", got)
 	}
 }
+
+// Tests that a multi-slot storage proof verifies all requested slots against the
+// account's storage root and doesn't duplicate shared nodes.
+func TestStorageSlotsProof(t *testing.T) {
+	state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()))
+	addr := common.HexToAddress("aaaa")
+	for i := byte(1); i < 100; i++ {
+		state.SetState(addr, common.BytesToHash([]byte{i}), common.BytesToHash([]byte{i, i}))
+	}
+	root, _ := state.Commit(false)
+	state, _ = New(root, state.Database())
+
+	slots := []common.Hash{common.BytesToHash([]byte{3}), common.BytesToHash([]byte{42})}
+	proof, err := state.GetStorageSlotsProof(addr, slots)
+	if err != nil {
+		t.Fatalf("failed to create proof: %v", err)
+	}
+	var single int
+	for _, slot := range slots {
+		nodes, _ := state.GetStorageProof(addr, slot)
+		single += len(nodes)
+	}
+	if len(proof) >= single {
+		t.Errorf("shared nodes not deduplicated: have %d nodes, separate proofs %d", len(proof), single)
+	}
+	proofDb := memorydb.New()
+	for _, node := range proof {
+		proofDb.Put(crypto.Keccak256(node), node)
+	}
+	storageRoot := state.StorageTrie(addr).Hash()
+	for _, slot := range slots {
+		enc, _, err := trie.VerifyProof(storageRoot, crypto.Keccak256(slot.Bytes()), proofDb)
+		if err != nil {
+			t.Fatalf("failed to verify slot %x: %v", slot, err)
+		}
+		var value []byte
+		if err := rlp.DecodeBytes(enc, &value); err != nil {
+			t.Fatalf("failed to decode slot %x: %v", slot, err)
+		}
+		if want := state.GetState(addr, slot); common.BytesToHash(value) != want {
+			t.Errorf("slot %x mismatch: have %x, want %x", slot, value, want)
+		}
+	}
+}
+
+func TestVerifyContractProof(t *testing.T) {
+	state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()))
+	addr, other := common.HexToAddress("aaaa"), common.HexToAddress("bbbb")
+	for i := byte(1); i < 100; i++ {
+		state.SetState(addr, common.BytesToHash([]byte{i}), common.BytesToHash([]byte{i, i}))
+		state.SetState(other, common.BytesToHash([]byte{i}), common.BytesToHash([]byte{i}))
+	}
+	state.SetNonce(addr, 7)
+	root, _ := state.Commit(false)
+	state, _ = New(root, state.Database())
+
+	slots := []common.Hash{common.BytesToHash([]byte{3}), common.BytesToHash([]byte{200})}
+	accountProof, _ := state.GetProof(addr)
+	storageProof, _ := state.GetStorageSlotsProof(addr, slots)
+
+	account, storage, err := VerifyContractProof(root, addr, accountProof, storageProof, slots)
+	if err != nil {
+		t.Fatalf("failed to verify proof: %v", err)
+	}
+	if account.Nonce != 7 || account.Root != state.StorageTrie(addr).Hash() {
+		t.Errorf("account mismatch: have nonce %d, root %x", account.Nonce, account.Root)
+	}
+	if have := storage[slots[0]]; !bytes.Equal(have, []byte{3, 3}) {
+		t.Errorf("slot %x mismatch: have %x, want 0303", slots[0], have)
+	}
+	if have, ok := storage[slots[1]]; !ok || have != nil {
+		t.Errorf("empty slot %x mismatch: have %x, present %v", slots[1], have, ok)
+	}
+	// A storage proof from another account's trie must be rejected
+	otherProof, _ := state.GetStorageSlotsProof(other, slots)
+	if _, _, err := VerifyContractProof(root, addr, accountProof, otherProof, slots); err == nil {
+		t.Errorf("storage proof of another account verified")
+	}
+	// An account without storage has an empty storage proof
+	eoa := common.HexToAddress("cccc")
+	state.SetBalance(eoa, big.NewInt(1))
+	root, _ = state.Commit(false)
+	state, _ = New(root, state.Database())
+
+	accountProof, _ = state.GetProof(eoa)
+	storageProof, _ = state.GetStorageSlotsProof(eoa, slots)
+	account, storage, err = VerifyContractProof(root, eoa, accountProof, storageProof, slots)
+	if err != nil {
+		t.Fatalf("failed to verify proof of account without storage: %v", err)
+	}
+	if account.Root != emptyRoot {
+		t.Errorf("account root mismatch: have %x, want %x", account.Root, emptyRoot)
+	}
+	for _, slot := range slots {
+		if have, ok := storage[slot]; !ok || have != nil {
+			t.Errorf("slot %x of account without storage mismatch: have %x, present %v", slot, have, ok)
+		}
+	}
+}
+
+func TestIterateStorage(t *testing.T) {
+	state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()))
+	addr := common.HexToAddress("aaaa")
+	for i := byte(1); i <= 50; i++ {
+		state.SetState(addr, common.BytesToHash([]byte{i}), common.BytesToHash([]byte{i, i}))
+	}
+	root, _ := state.Commit(false)
+	state, _ = New(root, state.Database())
+
+	// Collect all slots, checking their order and values
+	var (
+		hashes []common.Hash
+		count  int
+	)
+	err := state.IterateStorage(addr, common.Hash{}, func(key common.Hash, hashed bool, value []byte) error {
+		if hashed {
+			t.Errorf("slot %x reported without preimage", key)
+		}
+		if have, want := common.BytesToHash(value), state.GetState(addr, key); have != want {
+			t.Errorf("slot %x mismatch: have %x, want %x", key, have, want)
+		}
+		hashes = append(hashes, crypto.Keccak256Hash(key[:]))
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("iteration failed: %v", err)
+	}
+	if count != 50 {
+		t.Fatalf("slot count mismatch: have %d, want 50", count)
+	}
+	for i := 1; i < len(hashes); i++ {
+		if bytes.Compare(hashes[i-1][:], hashes[i][:]) >= 0 {
+			t.Fatalf("slots out of order at %d", i)
+		}
+	}
+	// Resume from the middle and stop on error
+	var resumed []common.Hash
+	stop := errors.New("stop")
+	err = state.IterateStorage(addr, hashes[20], func(key common.Hash, hashed bool, value []byte) error {
+		resumed = append(resumed, crypto.Keccak256Hash(key[:]))
+		if len(resumed) == 10 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("error mismatch: have %v, want %v", err, stop)
+	}
+	if !reflect.DeepEqual(resumed, hashes[20:30]) {
+		t.Errorf("resumed slots mismatch: have %x, want %x", resumed, hashes[20:30])
+	}
+	// Self-destructed accounts have no storage left
+	destructed := state.Copy()
+	destructed.Suicide(addr)
+	destructed.IterateStorage(addr, common.Hash{}, func(key common.Hash, hashed bool, value []byte) error {
+		t.Fatalf("slot %x of self-destructed account reported", key)
+		return nil
+	})
+	// Without preimages, slots are reported by their hashes
+	diskdb := rawdb.NewMemoryDatabase()
+	state, _ = New(common.Hash{}, NewDatabase(diskdb))
+	for i := byte(1); i <= 50; i++ {
+		state.SetState(addr, common.BytesToHash([]byte{i}), common.BytesToHash([]byte{i, i}))
+	}
+	root, _ = state.Commit(false)
+	state.Database().TrieDB().Commit(root, false)
+
+	var preimages [][]byte
+	for it := diskdb.NewIteratorWithPrefix([]byte("secure-key-")); it.Next(); {
+		preimages = append(preimages, common.CopyBytes(it.Key()))
+	}
+	for _, key := range preimages {
+		diskdb.Delete(key)
+	}
+	state, _ = New(root, NewDatabase(diskdb))
+	var index int
+	err = state.IterateStorage(addr, common.Hash{}, func(key common.Hash, hashed bool, value []byte) error {
+		if !hashed || key != hashes[index] {
+			t.Errorf("slot %d mismatch: have %x (hashed %v), want hash %x", index, key, hashed, hashes[index])
+		}
+		index++
+		return nil
+	})
+	if err != nil || index != 50 {
+		t.Errorf("iteration without preimages failed after %d slots: %v", index, err)
+	}
+}
+
+// Tests that an account whose storage is emptied ends up with exactly emptyRoot
+// as its storage root, not the zero hash.
+func TestEmptiedStorageRoot(t *testing.T) {
+	state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()))
+	addr := common.HexToAddress("aaaa")
+
+	state.CreateAccount(addr)
+	if root := state.getStateObject(addr).data.Root; root != emptyRoot {
+		t.Fatalf("fresh account root mismatch: have %x, want %x", root, emptyRoot)
+	}
+	for i := byte(1); i < 10; i++ {
+		state.SetState(addr, common.BytesToHash([]byte{i}), common.BytesToHash([]byte{i}))
+	}
+	root, _ := state.Commit(false)
+	state, _ = New(root, state.Database())
+	if root := state.getStateObject(addr).data.Root; root == emptyRoot {
+		t.Fatalf("account storage root not updated")
+	}
+	for i := byte(1); i < 10; i++ {
+		state.SetState(addr, common.BytesToHash([]byte{i}), common.Hash{})
+	}
+	root, _ = state.Commit(false)
+	state, _ = New(root, state.Database())
+	if root := state.getStateObject(addr).data.Root; root != emptyRoot {
+		t.Errorf("emptied account root mismatch: have %x, want %x", root, emptyRoot)
+	}
+}
+
+func TestCodeCacheLimit(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := NewDatabaseWithCodeCache(diskdb, 0, 2, 2)
+
+	var hashes []common.Hash
+	for i := 0; i < 3; i++ {
+		code := []byte{byte(i), 0x60, 0x00}
+		hash := crypto.Keccak256Hash(code)
+		diskdb.Put(hash[:], code)
+		hashes = append(hashes, hash)
+	}
+	for _, hash := range hashes {
+		if size, err := db.ContractCodeSize(common.Hash{}, hash); err != nil || size != 3 {
+			t.Fatalf("code size mismatch: have %d, want 3, err %v", size, err)
+		}
+	}
+	cache := db.(*cachingDB).codeSizeCache
+	if cache.Len() != 2 {
+		t.Errorf("cache size mismatch: have %d, want 2", cache.Len())
+	}
+	if cache.Contains(hashes[0]) {
+		t.Errorf("oldest code size not evicted")
+	}
+	// With the code gone from disk, only the two most recent blobs are served
+	for _, hash := range hashes {
+		db.ContractCode(common.Hash{}, hash)
+		diskdb.Delete(hash[:])
+	}
+	for i, hash := range hashes {
+		code, err := db.ContractCode(common.Hash{}, hash)
+		if evicted := i == 0; evicted != (err != nil) {
+			t.Errorf("code %d: have %x, err %v, want evicted %v", i, code, err, evicted)
+		}
+	}
+	// Non-positive sizes fall back to the defaults instead of disabling the caches
+	db = NewDatabaseWithCodeCache(diskdb, 0, 0, -1)
+	if _, err := db.ContractCodeSize(common.Hash{}, hashes[0]); err == nil {
+		t.Errorf("size of missing code found")
+	}
+}
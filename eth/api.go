@@ -34,6 +34,7 @@ import (
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/internal/ethapi"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -391,26 +392,49 @@ func storageRangeAt(st state.Trie, start []byte, maxResult int) (StorageRangeRes
 //
 // With one parameter, returns the list of accounts modified in the specified block.
 func (api *PrivateDebugAPI) GetModifiedAccountsByNumber(startNum uint64, endNum *uint64) ([]common.Address, error) {
+	startBlock, endBlock, err := api.blockRangeByNumber(startNum, endNum)
+	if err != nil {
+		return nil, err
+	}
+	return api.getModifiedAccounts(startBlock, endBlock)
+}
+
+// GetModifiedStorageByNumber returns the storage slots of every account that
+// have changed between the two blocks specified, including deleted ones. Slots
+// are reported by their preimage where known and by their hash otherwise.
+//
+// With one parameter, returns the slots modified in the specified block.
+func (api *PrivateDebugAPI) GetModifiedStorageByNumber(startNum uint64, endNum *uint64) (map[common.Address][]common.Hash, error) {
+	startBlock, endBlock, err := api.blockRangeByNumber(startNum, endNum)
+	if err != nil {
+		return nil, err
+	}
+	return api.getModifiedStorage(startBlock, endBlock)
+}
+
+// blockRangeByNumber looks up the blocks delimiting a range of modifications.
+// If no end is given, the range spans the start block and its parent.
+func (api *PrivateDebugAPI) blockRangeByNumber(startNum uint64, endNum *uint64) (*types.Block, *types.Block, error) {
 	var startBlock, endBlock *types.Block
 
 	startBlock = api.eth.blockchain.GetBlockByNumber(startNum)
 	if startBlock == nil {
-		return nil, fmt.Errorf("start block %x not found", startNum)
+		return nil, nil, fmt.Errorf("start block %x not found", startNum)
 	}
 
 	if endNum == nil {
 		endBlock = startBlock
 		startBlock = api.eth.blockchain.GetBlockByHash(startBlock.ParentHash())
 		if startBlock == nil {
-			return nil, fmt.Errorf("block %x has no parent", endBlock.Number())
+			return nil, nil, fmt.Errorf("block %x has no parent", endBlock.Number())
 		}
 	} else {
 		endBlock = api.eth.blockchain.GetBlockByNumber(*endNum)
 		if endBlock == nil {
-			return nil, fmt.Errorf("end block %d not found", *endNum)
+			return nil, nil, fmt.Errorf("end block %d not found", *endNum)
 		}
 	}
-	return api.getModifiedAccounts(startBlock, endBlock)
+	return startBlock, endBlock, nil
 }
 
 // GetModifiedAccountsByHash returns all accounts that have changed between the
@@ -419,25 +443,48 @@ func (api *PrivateDebugAPI) GetModifiedAccountsByNumber(startNum uint64, endNum
 //
 // With one parameter, returns the list of accounts modified in the specified block.
 func (api *PrivateDebugAPI) GetModifiedAccountsByHash(startHash common.Hash, endHash *common.Hash) ([]common.Address, error) {
+	startBlock, endBlock, err := api.blockRangeByHash(startHash, endHash)
+	if err != nil {
+		return nil, err
+	}
+	return api.getModifiedAccounts(startBlock, endBlock)
+}
+
+// GetModifiedStorageByHash returns the storage slots of every account that
+// have changed between the two blocks specified, including deleted ones. Slots
+// are reported by their preimage where known and by their hash otherwise.
+//
+// With one parameter, returns the slots modified in the specified block.
+func (api *PrivateDebugAPI) GetModifiedStorageByHash(startHash common.Hash, endHash *common.Hash) (map[common.Address][]common.Hash, error) {
+	startBlock, endBlock, err := api.blockRangeByHash(startHash, endHash)
+	if err != nil {
+		return nil, err
+	}
+	return api.getModifiedStorage(startBlock, endBlock)
+}
+
+// blockRangeByHash looks up the blocks delimiting a range of modifications.
+// If no end is given, the range spans the start block and its parent.
+func (api *PrivateDebugAPI) blockRangeByHash(startHash common.Hash, endHash *common.Hash) (*types.Block, *types.Block, error) {
 	var startBlock, endBlock *types.Block
 	startBlock = api.eth.blockchain.GetBlockByHash(startHash)
 	if startBlock == nil {
-		return nil, fmt.Errorf("start block %x not found", startHash)
+		return nil, nil, fmt.Errorf("start block %x not found", startHash)
 	}
 
 	if endHash == nil {
 		endBlock = startBlock
 		startBlock = api.eth.blockchain.GetBlockByHash(startBlock.ParentHash())
 		if startBlock == nil {
-			return nil, fmt.Errorf("block %x has no parent", endBlock.Number())
+			return nil, nil, fmt.Errorf("block %x has no parent", endBlock.Number())
 		}
 	} else {
 		endBlock = api.eth.blockchain.GetBlockByHash(*endHash)
 		if endBlock == nil {
-			return nil, fmt.Errorf("end block %x not found", *endHash)
+			return nil, nil, fmt.Errorf("end block %x not found", *endHash)
 		}
 	}
-	return api.getModifiedAccounts(startBlock, endBlock)
+	return startBlock, endBlock, nil
 }
 
 func (api *PrivateDebugAPI) getModifiedAccounts(startBlock, endBlock *types.Block) ([]common.Address, error) {
@@ -467,3 +514,110 @@ func (api *PrivateDebugAPI) getModifiedAccounts(startBlock, endBlock *types.Bloc
 	}
 	return dirty, nil
 }
+
+func (api *PrivateDebugAPI) getModifiedStorage(startBlock, endBlock *types.Block) (map[common.Address][]common.Hash, error) {
+	if startBlock.Number().Uint64() >= endBlock.Number().Uint64() {
+		return nil, fmt.Errorf("start block height (%d) must be less than end block height (%d)", startBlock.Number().Uint64(), endBlock.Number().Uint64())
+	}
+	return modifiedStorage(api.eth.BlockChain().StateCache(), startBlock.Root(), endBlock.Root())
+}
+
+// modifiedStorage diffs the storage tries of all accounts changed between two
+// state roots, collecting the slots added, changed or deleted.
+func modifiedStorage(db state.Database, oldRoot, newRoot common.Hash) (map[common.Address][]common.Hash, error) {
+	oldTrie, err := db.OpenTrie(oldRoot)
+	if err != nil {
+		return nil, err
+	}
+	newTrie, err := db.OpenTrie(newRoot)
+	if err != nil {
+		return nil, err
+	}
+	dirty := make(map[common.Address][]common.Hash)
+	seen := make(map[common.Hash]bool)
+
+	// Accounts may be created, changed or deleted, so diff in both directions
+	for _, pair := range [][2]state.Trie{{oldTrie, newTrie}, {newTrie, oldTrie}} {
+		diff, _ := trie.NewDifferenceIterator(pair[0].NodeIterator(nil), pair[1].NodeIterator(nil))
+		iter := trie.NewIterator(diff)
+		for iter.Next() {
+			addrHash := common.BytesToHash(iter.Key)
+			if seen[addrHash] {
+				continue
+			}
+			seen[addrHash] = true
+
+			key := newTrie.GetKey(iter.Key)
+			if key == nil {
+				return nil, fmt.Errorf("no preimage found for hash %x", iter.Key)
+			}
+			addr := common.BytesToAddress(key)
+			oldStorage, err := openStorageTrie(db, oldTrie, addr)
+			if err != nil {
+				return nil, err
+			}
+			newStorage, err := openStorageTrie(db, newTrie, addr)
+			if err != nil {
+				return nil, err
+			}
+			if oldStorage.Hash() == newStorage.Hash() {
+				continue
+			}
+			slots, err := storageDiff(oldStorage, newStorage)
+			if err != nil {
+				return nil, err
+			}
+			dirty[addr] = slots
+		}
+		if iter.Err != nil {
+			return nil, iter.Err
+		}
+	}
+	return dirty, nil
+}
+
+// openStorageTrie opens the storage trie of an account in the given account
+// trie. Missing accounts get an empty storage trie.
+func openStorageTrie(db state.Database, accounts state.Trie, addr common.Address) (state.Trie, error) {
+	enc, err := accounts.TryGet(addr[:])
+	if err != nil {
+		return nil, err
+	}
+	var root common.Hash
+	if len(enc) > 0 {
+		var account state.Account
+		if err := rlp.DecodeBytes(enc, &account); err != nil {
+			return nil, err
+		}
+		root = account.Root
+	}
+	return db.OpenStorageTrie(crypto.Keccak256Hash(addr[:]), root)
+}
+
+// storageDiff returns the slots differing between two storage tries.
+func storageDiff(oldStorage, newStorage state.Trie) ([]common.Hash, error) {
+	var (
+		slots []common.Hash
+		seen  = make(map[common.Hash]bool)
+	)
+	for _, pair := range [][2]state.Trie{{oldStorage, newStorage}, {newStorage, oldStorage}} {
+		diff, _ := trie.NewDifferenceIterator(pair[0].NodeIterator(nil), pair[1].NodeIterator(nil))
+		iter := trie.NewIterator(diff)
+		for iter.Next() {
+			slot := common.BytesToHash(iter.Key)
+			if seen[slot] {
+				continue
+			}
+			seen[slot] = true
+
+			if key := pair[1].GetKey(iter.Key); key != nil {
+				slot = common.BytesToHash(key)
+			}
+			slots = append(slots, slot)
+		}
+		if iter.Err != nil {
+			return nil, iter.Err
+		}
+	}
+	return slots, nil
+}
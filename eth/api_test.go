@@ -17,7 +17,10 @@
 package eth
 
 import (
+	"bytes"
+	"math/big"
 	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/davecgh/go-spew/spew"
@@ -88,3 +91,40 @@ func TestStorageRangeAt(t *testing.T) {
 		}
 	}
 }
+
+func TestModifiedStorage(t *testing.T) {
+	var (
+		db         = state.NewDatabase(rawdb.NewMemoryDatabase())
+		statedb, _ = state.New(common.Hash{}, db)
+		changed    = common.Address{0x01}
+		created    = common.Address{0x02}
+		constant   = common.Address{0x03}
+	)
+	statedb.SetState(changed, common.Hash{0x01}, common.Hash{0x01})
+	statedb.SetState(changed, common.Hash{0x02}, common.Hash{0x02})
+	statedb.SetState(changed, common.Hash{0x03}, common.Hash{0x03})
+	statedb.SetState(constant, common.Hash{0x01}, common.Hash{0x01})
+	oldRoot, _ := statedb.Commit(false)
+
+	statedb.SetState(changed, common.Hash{0x01}, common.Hash{0x11}) // changed
+	statedb.SetState(changed, common.Hash{0x02}, common.Hash{})     // deleted
+	statedb.SetState(changed, common.Hash{0x04}, common.Hash{0x04}) // added
+	statedb.SetState(created, common.Hash{0x01}, common.Hash{0x01})
+	statedb.SetBalance(constant, big.NewInt(1)) // account change without storage change
+	newRoot, _ := statedb.Commit(false)
+
+	dirty, err := modifiedStorage(db, oldRoot, newRoot)
+	if err != nil {
+		t.Fatalf("failed to diff storage: %v", err)
+	}
+	for _, slots := range dirty {
+		sort.Slice(slots, func(i, j int) bool { return bytes.Compare(slots[i][:], slots[j][:]) < 0 })
+	}
+	want := map[common.Address][]common.Hash{
+		changed: {{0x01}, {0x02}, {0x04}},
+		created: {{0x01}},
+	}
+	if !reflect.DeepEqual(dirty, want) {
+		t.Errorf("modified storage mismatch:\nhave %s\nwant %s", dumper.Sdump(dirty), dumper.Sdump(want))
+	}
+}
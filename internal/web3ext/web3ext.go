@@ -449,6 +449,18 @@ web3._extend({
 			params: 2,
 			inputFormatter:[null, null],
 		}),
+		new web3._extend.Method({
+			name: 'getModifiedStorageByNumber',
+			call: 'debug_getModifiedStorageByNumber',
+			params: 2,
+			inputFormatter: [null, null],
+		}),
+		new web3._extend.Method({
+			name: 'getModifiedStorageByHash',
+			call: 'debug_getModifiedStorageByHash',
+			params: 2,
+			inputFormatter: [null, null],
+		}),
 	],
 	properties: []
 });
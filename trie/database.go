@@ -361,14 +361,15 @@ func (db *Database) insertPreimage(hash common.Hash, preimage []byte) {
 }
 
 // node retrieves a cached trie node from memory, or returns nil if none can be
-// found in the memory cache.
-func (db *Database) node(hash common.Hash) node {
+// found in the memory cache. The size of the node's RLP encoding is returned
+// alongside it.
+func (db *Database) node(hash common.Hash) (node, int) {
 	// Retrieve the node from the clean cache if available
 	if db.cleans != nil {
 		if enc, err := db.cleans.Get(string(hash[:])); err == nil && enc != nil {
 			memcacheCleanHitMeter.Mark(1)
 			memcacheCleanReadMeter.Mark(int64(len(enc)))
-			return mustDecodeNode(hash[:], enc)
+			return mustDecodeNode(hash[:], enc), len(enc)
 		}
 	}
 	// Retrieve the node from the dirty cache if available
@@ -377,19 +378,19 @@ func (db *Database) node(hash common.Hash) node {
 	db.lock.RUnlock()
 
 	if dirty != nil {
-		return dirty.obj(hash)
+		return dirty.obj(hash), int(dirty.size)
 	}
 	// Content unavailable in memory, attempt to retrieve from disk
 	enc, err := db.diskdb.Get(hash[:])
 	if err != nil || enc == nil {
-		return nil
+		return nil, 0
 	}
 	if db.cleans != nil {
 		db.cleans.Set(string(hash[:]), enc)
 		memcacheCleanMissMeter.Mark(1)
 		memcacheCleanWriteMeter.Mark(int64(len(enc)))
 	}
-	return mustDecodeNode(hash[:], enc)
+	return mustDecodeNode(hash[:], enc), len(enc)
 }
 
 // Node retrieves an encoded cached trie node from memory. If it cannot be found
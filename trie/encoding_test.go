@@ -19,6 +19,9 @@ package trie
 import (
 	"bytes"
 	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 func TestHexCompact(t *testing.T) {
@@ -75,6 +78,51 @@ func TestHexKeybytes(t *testing.T) {
 	}
 }
 
+// keyHexLen is the length of a hashed (secure trie) key in HEX encoding: two
+// nibbles for each key byte plus the trailing terminator.
+const keyHexLen = 2*common.HashLength + 1
+
+// Tests that the nibbles consumed along the path of every hashed key add up to
+// exactly keyHexLen, terminator included.
+func TestHashKeyHexLen(t *testing.T) {
+	trie := newEmpty()
+	var keys [][]byte
+	for i := 0; i < 256; i++ {
+		key := crypto.Keccak256([]byte{byte(i)})
+		trie.Update(key, []byte{byte(i)})
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		hex := keybytesToHex(key)
+		if len(hex) != keyHexLen || !hasTerm(hex) {
+			t.Fatalf("hex key %x: have length %d, want %d with terminator", hex, len(hex), keyHexLen)
+		}
+		pos, n := 0, trie.root
+	walk:
+		for {
+			switch nn := n.(type) {
+			case *shortNode:
+				if pos+len(nn.Key) > keyHexLen {
+					t.Fatalf("key %x: short node overruns key at %d+%d", key, pos, len(nn.Key))
+				}
+				pos, n = pos+len(nn.Key), nn.Val
+			case *fullNode:
+				if pos >= keyHexLen-1 {
+					t.Fatalf("key %x: full node at terminator position %d", key, pos)
+				}
+				pos, n = pos+1, nn.Children[hex[pos]]
+			case valueNode:
+				break walk
+			default:
+				t.Fatalf("key %x: unexpected node %T at %d", key, n, pos)
+			}
+		}
+		if pos != keyHexLen {
+			t.Errorf("key %x: value reached after %d nibbles, want %d", key, pos, keyHexLen)
+		}
+	}
+}
+
 func BenchmarkHexToCompact(b *testing.B) {
 	testBytes := []byte{0, 15, 1, 12, 11, 8, 16 /*term*/}
 	for i := 0; i < b.N; i++ {
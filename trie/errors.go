@@ -17,19 +17,37 @@
 package trie
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
 )
 
+// ErrFrozen is returned by the trie mutation functions (TryUpdate, TryDelete)
+// if the trie has been frozen and may only be read from.
+var ErrFrozen = errors.New("trie is frozen")
+
+// ErrEmbeddedNodeReferenced is returned if a node which is small enough to be
+// embedded into its parent is referenced by hash instead, signalling a corrupt
+// trie or database.
+var ErrEmbeddedNodeReferenced = errors.New("embedded trie node referenced by hash")
+
+// errNotResident is returned internally if a node needs to be resolved from the
+// database while the trie is restricted to in-memory operation.
+var errNotResident = errors.New("trie node not resident in memory")
+
 // MissingNodeError is returned by the trie functions (TryGet, TryUpdate, TryDelete)
 // in the case where a trie node is not present in the local database. It contains
 // information necessary for retrieving the missing node.
 type MissingNodeError struct {
 	NodeHash common.Hash // hash of the missing node
 	Path     []byte      // hex-encoded path to the missing node
+	Prefix   []byte      // prefix identifying the trie (e.g. owner account hash), nil if none
 }
 
 func (err *MissingNodeError) Error() string {
+	if err.Prefix != nil {
+		return fmt.Sprintf("missing trie node %x (prefix %x, path %x)", err.NodeHash, err.Prefix, err.Path)
+	}
 	return fmt.Sprintf("missing trie node %x (path %x)", err.NodeHash, err.Path)
 }
@@ -26,9 +26,11 @@ import (
 )
 
 type hasher struct {
-	tmp    sliceBuffer
-	sha    keccakState
-	onleaf LeafCallback
+	tmp      sliceBuffer
+	sha      keccakState
+	onleaf   LeafCallback
+	oncommit CommitCallback
+	stats    HashStats
 }
 
 // keccakState wraps sha3.state. In addition to the usual hash methods, it also supports
@@ -63,9 +65,34 @@ var hasherPool = sync.Pool{
 func newHasher(onleaf LeafCallback) *hasher {
 	h := hasherPool.Get().(*hasher)
 	h.onleaf = onleaf
+	h.oncommit = nil
+	h.stats = HashStats{}
 	return h
 }
 
+// emptyStringRLP is the encoding of an empty trie, hashing to its root.
+var emptyStringRLP = []byte{0x80}
+
+// sumState adapts a plain hash.Hash to keccakState, reading the digest
+// through Sum.
+type sumState struct {
+	hash.Hash
+}
+
+func (s sumState) Read(b []byte) (int, error) {
+	return copy(b, s.Sum(nil)), nil
+}
+
+// newCustomHasher creates a hasher using the given hash function. Unlike the
+// pooled Keccak hashers it must not be returned to the pool.
+func newCustomHasher(onleaf LeafCallback, factory func() hash.Hash) *hasher {
+	return &hasher{
+		tmp:    make(sliceBuffer, 0, 550),
+		sha:    sumState{factory()},
+		onleaf: onleaf,
+	}
+}
+
 func returnHasherToPool(h *hasher) {
 	hasherPool.Put(h)
 }
@@ -76,9 +103,11 @@ func (h *hasher) hash(n node, db *Database, force bool) (node, node, error) {
 	// If we're not storing the node, just hashing, use available cached data
 	if hash, dirty := n.cache(); hash != nil {
 		if db == nil {
+			h.stats.Cached++
 			return hash, n, nil
 		}
 		if !dirty {
+			h.stats.Cached++
 			switch n.(type) {
 			case *fullNode, *shortNode:
 				return hash, hash, nil
@@ -88,6 +117,10 @@ func (h *hasher) hash(n node, db *Database, force bool) (node, node, error) {
 		}
 	}
 	// Trie not processed yet or needs storage, walk the children
+	switch n.(type) {
+	case *shortNode, *fullNode:
+		h.stats.Computed++
+	}
 	collapsed, cached, err := h.hashChildren(n, db)
 	if err != nil {
 		return hashNode{}, n, err
@@ -157,6 +190,121 @@ func (h *hasher) hashChildren(original node, db *Database) (node, node, error) {
 	}
 }
 
+// parallelHashThreshold is the number of nodes needing rehashing below which
+// hashing them concurrently doesn't make up for the goroutine overhead.
+const parallelHashThreshold = 256
+
+// hashParallel is the equivalent of hash without a database, but hashes the
+// dirty children of the top level full node (or the one below a top level
+// extension) concurrently using at most the given number of goroutines, each
+// with its own hasher. Tries with few nodes to rehash are hashed sequentially.
+func hashParallel(n node, workers int) (node, node, HashStats) {
+	if workers < 2 || countUnhashed(n, parallelHashThreshold) < parallelHashThreshold {
+		h := newHasher(nil)
+		defer returnHasherToPool(h)
+		hashed, cached, _ := h.hash(n, nil, true)
+		return hashed, cached, h.stats
+	}
+	return hashConcurrently(n, workers, true)
+}
+
+func hashConcurrently(n node, workers int, force bool) (node, node, HashStats) {
+	h := newHasher(nil)
+	defer returnHasherToPool(h)
+
+	switch n := n.(type) {
+	case *shortNode:
+		fn, ok := n.Val.(*fullNode)
+		if !ok || n.flags.hash != nil {
+			break
+		}
+		// Extension above the branch to parallelize, collapse it around the branch
+		collapsed, cached := n.copy(), n.copy()
+		collapsed.Key = hexToCompact(n.Key)
+		cached.Key = common.CopyBytes(n.Key)
+
+		var stats HashStats
+		collapsed.Val, cached.Val, stats = hashConcurrently(fn, workers, false)
+		stats.Computed++
+
+		hashed, _ := h.store(collapsed, nil, force)
+		cached.flags.hash, _ = hashed.(hashNode)
+		return hashed, cached, stats
+
+	case *fullNode:
+		if n.flags.hash != nil {
+			break
+		}
+		collapsed, cached := n.copy(), n.copy()
+
+		var (
+			wg    sync.WaitGroup
+			sem   = make(chan struct{}, workers)
+			stats [16]HashStats
+		)
+		for i := 0; i < 16; i++ {
+			if n.Children[i] == nil {
+				continue
+			}
+			// Children with cached hashes are not worth a goroutine
+			if countUnhashed(n.Children[i], 1) == 0 {
+				collapsed.Children[i], cached.Children[i], _ = h.hash(n.Children[i], nil, false)
+				continue
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer func() { <-sem; wg.Done() }()
+
+				h := newHasher(nil)
+				defer returnHasherToPool(h)
+				collapsed.Children[i], cached.Children[i], _ = h.hash(n.Children[i], nil, false)
+				stats[i] = h.stats
+			}(i)
+		}
+		wg.Wait()
+		cached.Children[16] = n.Children[16]
+
+		// The node itself is always recomputed, add it to the children's counts
+		total := HashStats{Computed: h.stats.Computed + 1, Cached: h.stats.Cached}
+		for _, s := range stats {
+			total.Computed += s.Computed
+			total.Cached += s.Cached
+		}
+		hashed, _ := h.store(collapsed, nil, force)
+		cached.flags.hash, _ = hashed.(hashNode)
+		return hashed, cached, total
+	}
+	hashed, cached, _ := h.hash(n, nil, force)
+	return hashed, cached, h.stats
+}
+
+// countUnhashed counts the short and full nodes without a cached hash in the
+// given subtrie, stopping early once limit is reached.
+func countUnhashed(n node, limit int) int {
+	switch n := n.(type) {
+	case *shortNode:
+		if n.flags.hash != nil {
+			return 0
+		}
+		return 1 + countUnhashed(n.Val, limit-1)
+	case *fullNode:
+		if n.flags.hash != nil {
+			return 0
+		}
+		count := 1
+		for _, child := range &n.Children {
+			if count >= limit {
+				break
+			}
+			count += countUnhashed(child, limit-count)
+		}
+		return count
+	default:
+		return 0
+	}
+}
+
 // store hashes the node n and if we have a storage layer specified, it writes
 // the key/value pair to it and tracks any node->child references as well as any
 // node->external trie references.
@@ -187,6 +335,10 @@ func (h *hasher) store(n node, db *Database, force bool) (node, error) {
 		db.insert(hash, h.tmp, n)
 		db.lock.Unlock()
 
+		if h.oncommit != nil {
+			h.oncommit(hash, h.tmp)
+		}
+
 		// Track external references from account->storage trie
 		if h.onleaf != nil {
 			switch n := n.(type) {
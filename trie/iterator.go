@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"container/heap"
 	"errors"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -56,6 +57,19 @@ func (it *Iterator) Next() bool {
 	return false
 }
 
+// Seek repositions the iterator just before the first entry at or after the
+// given key, as if it had been created with key as its start. It fails if the
+// underlying node iterator doesn't support seeking.
+func (it *Iterator) Seek(key []byte) error {
+	seeker, ok := it.nodeIt.(*nodeIterator)
+	if !ok {
+		return errors.New("node iterator doesn't support seeking")
+	}
+	seeker.Seek(key)
+	it.Key, it.Value, it.Err = nil, nil, nil
+	return nil
+}
+
 // Prove generates the Merkle proof for the leaf node the iterator is currently
 // positioned on.
 func (it *Iterator) Prove() [][]byte {
@@ -116,6 +130,7 @@ type nodeIterator struct {
 	trie  *Trie                // Trie being iterated
 	stack []*nodeIteratorState // Hierarchy of trie nodes persisting the iteration state
 	path  []byte               // Path to the current node
+	end   []byte               // Hex path at which iteration stops (nil if unbounded)
 	err   error                // Failure set in case of an internal error in the iterator
 }
 
@@ -133,10 +148,21 @@ func (e seekError) Error() string {
 }
 
 func newNodeIterator(trie *Trie, start []byte) NodeIterator {
-	if trie.Hash() == emptyState {
-		return new(nodeIterator)
+	return newRangeNodeIterator(trie, start, nil)
+}
+
+// newRangeNodeIterator creates a node iterator over the keys in [start, end),
+// or all keys from start on if end is nil. Nodes whose whole subtree lies at or
+// beyond end are never resolved, not even while seeking to start.
+func newRangeNodeIterator(trie *Trie, start, end []byte) NodeIterator {
+	if trie.IsEmpty() {
+		return &nodeIterator{trie: trie, err: errIteratorEnd}
 	}
 	it := &nodeIterator{trie: trie}
+	if end != nil {
+		it.end = keybytesToHex(end)
+		it.end = it.end[:len(it.end)-1]
+	}
 	it.err = it.seek(start)
 	return it
 }
@@ -237,6 +263,26 @@ func (it *nodeIterator) Next(descend bool) bool {
 	return true
 }
 
+// Seek repositions the iterator just before the first node at or after the
+// given key, as if it had been created with key as its start. Nodes on the
+// path shared with the current position are reused instead of resolved again.
+func (it *nodeIterator) Seek(key []byte) {
+	if it.trie == nil || it.trie.IsEmpty() {
+		return
+	}
+	hexkey := keybytesToHex(key)
+	hexkey = hexkey[:len(hexkey)-1]
+
+	// Unwind to the deepest node strictly above the key and revisit its children
+	for len(it.stack) > 0 && (len(it.path) >= len(hexkey) || !bytes.HasPrefix(hexkey, it.path)) {
+		it.pop()
+	}
+	if len(it.stack) > 0 {
+		it.stack[len(it.stack)-1].index = -1
+	}
+	it.err = it.seek(key)
+}
+
 func (it *nodeIterator) seek(prefix []byte) error {
 	// The path we're looking for is the hex encoded key without terminator.
 	key := keybytesToHex(prefix)
@@ -281,6 +327,12 @@ func (it *nodeIterator) peek(descend bool) (*nodeIteratorState, *int, []byte, er
 		}
 		state, path, ok := it.nextChild(parent, ancestor)
 		if ok {
+			if it.pastEnd(path) {
+				// Skip the child without resolving it. Later siblings are past
+				// the end too, apart from a branch value which sorts first.
+				parent.index++
+				continue
+			}
 			if err := state.resolve(it.trie, path); err != nil {
 				return parent, &parent.index, path, err
 			}
@@ -292,6 +344,22 @@ func (it *nodeIterator) peek(descend bool) (*nodeIteratorState, *int, []byte, er
 	return nil, nil, nil, errIteratorEnd
 }
 
+// pastEnd reports whether every key below the given path is at or beyond
+// the end bound of the iterator.
+func (it *nodeIterator) pastEnd(path []byte) bool {
+	if it.end == nil {
+		return false
+	}
+	if hasTerm(path) {
+		path = path[:len(path)-1]
+	}
+	// The smallest key below an odd length path continues with a zero nibble
+	if len(path)&1 == 1 {
+		return bytes.Compare(append(path[:len(path):len(path)], 0), it.end) >= 0
+	}
+	return bytes.Compare(path, it.end) >= 0
+}
+
 func (st *nodeIteratorState) resolve(tr *Trie, path []byte) error {
 	if hash, ok := st.node.(hashNode); ok {
 		resolved, err := tr.resolveHash(hash, path)
@@ -469,6 +537,59 @@ func (it *differenceIterator) Error() error {
 	return it.b.Error()
 }
 
+// TrieChange is a single key differing between two tries. Old is nil for keys
+// that were added, New is nil for keys that were deleted.
+type TrieChange struct {
+	Key []byte
+	Old []byte
+	New []byte
+}
+
+// DiffTries returns the keys differing between the tries with the given roots,
+// sorted by key. Subtries with identical hashes in both are skipped without
+// being loaded from the database.
+func DiffTries(db *Database, rootA, rootB common.Hash) ([]TrieChange, error) {
+	a, err := New(rootA, db)
+	if err != nil {
+		return nil, err
+	}
+	b, err := New(rootB, db)
+	if err != nil {
+		return nil, err
+	}
+	changes := make(map[string]*TrieChange)
+
+	// Keys only in b (or with a different value) first, then the ones only in a
+	diff, _ := NewDifferenceIterator(a.NodeIterator(nil), b.NodeIterator(nil))
+	it := NewIterator(diff)
+	for it.Next() {
+		changes[string(it.Key)] = &TrieChange{Key: common.CopyBytes(it.Key), New: common.CopyBytes(it.Value)}
+	}
+	if it.Err != nil {
+		return nil, it.Err
+	}
+	diff, _ = NewDifferenceIterator(b.NodeIterator(nil), a.NodeIterator(nil))
+	it = NewIterator(diff)
+	for it.Next() {
+		change := changes[string(it.Key)]
+		if change == nil {
+			change = &TrieChange{Key: common.CopyBytes(it.Key)}
+			changes[string(it.Key)] = change
+		}
+		change.Old = common.CopyBytes(it.Value)
+	}
+	if it.Err != nil {
+		return nil, it.Err
+	}
+	// Keys whose value changed showed up in both directions and are merged
+	result := make([]TrieChange, 0, len(changes))
+	for _, change := range changes {
+		result = append(result, *change)
+	}
+	sort.Slice(result, func(i, j int) bool { return bytes.Compare(result[i].Key, result[j].Key) < 0 })
+	return result, nil
+}
+
 type nodeIteratorHeap []NodeIterator
 
 func (h nodeIteratorHeap) Len() int            { return len(h) }
@@ -18,11 +18,15 @@ package trie
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 )
 
@@ -130,6 +134,52 @@ func TestNodeIteratorCoverage(t *testing.T) {
 	it.Release()
 }
 
+// Tests that the node iterator reports the hex path of every node along with
+// its hash, or the zero hash for embedded and value nodes.
+func TestNodeIteratorPathHash(t *testing.T) {
+	triedb := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, triedb)
+	trie.Update([]byte{0x12}, bytes.Repeat([]byte{'x'}, 40))
+	trie.Update([]byte{0x13}, bytes.Repeat([]byte{'y'}, 40))
+	root, _ := trie.Commit(nil)
+	trie, _ = New(root, triedb)
+
+	// short(1) -> full{2: short(value), 3: short(value)}, all stored by hash
+	want := []struct {
+		path   []byte
+		hashed bool
+	}{
+		{[]byte{}, true},
+		{[]byte{1}, true},
+		{[]byte{1, 2}, true},
+		{[]byte{1, 2, 16}, false},
+		{[]byte{1, 3}, true},
+		{[]byte{1, 3, 16}, false},
+	}
+	it := trie.NodeIterator(nil)
+	for i := 0; it.Next(true); i++ {
+		if i >= len(want) {
+			t.Fatalf("unexpected node at path %x", it.Path())
+		}
+		if !bytes.Equal(it.Path(), want[i].path) {
+			t.Fatalf("node %d: path mismatch: have %x, want %x", i, it.Path(), want[i].path)
+		}
+		if hashed := it.Hash() != (common.Hash{}); hashed != want[i].hashed {
+			t.Fatalf("node %d: hash presence mismatch: have %x", i, it.Hash())
+		}
+		if !want[i].hashed {
+			continue
+		}
+		// The reported hash must be the one of the node at the reported path
+		if found, path, err := trie.ContainsHash(it.Hash()); err != nil || !found || !bytes.Equal(path, it.Path()) {
+			t.Errorf("node %d: hash %x not at path %x: found %v at %x, err %v", i, it.Hash(), it.Path(), found, path, err)
+		}
+	}
+	if it.Error() != nil {
+		t.Fatalf("iteration failed: %v", it.Error())
+	}
+}
+
 type kvs struct{ k, v string }
 
 var testdata1 = []kvs{
@@ -180,6 +230,211 @@ func TestIteratorSeek(t *testing.T) {
 	}
 }
 
+func TestTrieIterator(t *testing.T) {
+	trie := newEmpty()
+	for _, val := range testdata1 {
+		trie.Update([]byte(val.k), []byte(val.v))
+	}
+	root, _ := trie.Commit(nil)
+	trie, _ = New(root, trie.db)
+
+	it := trie.Iterator([]byte("bars"))
+	want := testdata1[2:]
+	for it.Next() {
+		if len(want) == 0 {
+			t.Fatalf("didn't expect any more values, got key %q", it.Key)
+		}
+		if !bytes.Equal(it.Key, []byte(want[0].k)) || !bytes.Equal(it.Value, []byte(want[0].v)) {
+			t.Fatalf("entry mismatch: have %q => %q, want %q => %q", it.Key, it.Value, want[0].k, want[0].v)
+		}
+		want = want[1:]
+	}
+	if it.Err != nil {
+		t.Fatalf("iteration failed: %v", it.Err)
+	}
+	if len(want) > 0 {
+		t.Fatalf("iterator ended early, want key %q", want[0].k)
+	}
+}
+
+// readRecordingDB is a key-value store remembering every key read from it.
+type readRecordingDB struct {
+	ethdb.KeyValueStore
+	reads map[string]struct{}
+}
+
+func (db *readRecordingDB) Get(key []byte) ([]byte, error) {
+	db.reads[string(key)] = struct{}{}
+	return db.KeyValueStore.Get(key)
+}
+
+func TestNodeIteratorRange(t *testing.T) {
+	diskdb := &readRecordingDB{KeyValueStore: memorydb.New(), reads: make(map[string]struct{})}
+	triedb := NewDatabase(diskdb)
+
+	trie, _ := New(common.Hash{}, triedb)
+	want := 0
+	for i := 0; i < 1000; i++ {
+		key := crypto.Keccak256([]byte{byte(i), byte(i >> 8)})
+		trie.Update(key, bytes.Repeat([]byte{byte(i)}, 32))
+		if key[0] < 0x10 {
+			want++
+		}
+	}
+	root, _ := trie.Commit(nil)
+	triedb.Commit(root, false)
+
+	// Map every stored node to its path for checking the reads later on
+	paths := make(map[common.Hash][]byte)
+	for it := trie.NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) {
+			paths[it.Hash()] = common.CopyBytes(it.Path())
+		}
+	}
+	// Iterate the first nibble range on a fresh database and check the reads
+	trie, _ = New(root, NewDatabase(diskdb))
+	end := []byte{0x10}
+
+	have := 0
+	for it := NewIterator(trie.NodeIteratorRange(nil, end)); it.Next(); have++ {
+		if bytes.Compare(it.Key, end) >= 0 {
+			t.Fatalf("key %x beyond end %x", it.Key, end)
+		}
+	}
+	if have != want {
+		t.Errorf("leaf count mismatch: have %d, want %d", have, want)
+	}
+	for key := range diskdb.reads {
+		path, ok := paths[common.BytesToHash([]byte(key))]
+		if !ok {
+			continue
+		}
+		if len(path) > 0 && path[0] >= 0x1 {
+			t.Errorf("resolved node outside of range at path %x", path)
+		}
+	}
+}
+
+func TestWalkRange(t *testing.T) {
+	trie := newEmpty()
+	for _, val := range testdata1 {
+		trie.Update([]byte(val.k), []byte(val.v))
+	}
+	walk := func(start, end []byte, limit int) []string {
+		var keys []string
+		err := trie.WalkRange(start, end, func(key, value []byte) (bool, error) {
+			keys = append(keys, string(key))
+			return len(keys) < limit, nil
+		})
+		if err != nil {
+			t.Fatalf("walk failed: %v", err)
+		}
+		return keys
+	}
+	tests := []struct {
+		start, end string
+		limit      int
+		want       []string
+	}{
+		{"", "", 100, []string{"barb", "bard", "bars", "bar", "fab", "food", "foos", "foo"}},
+		{"bard", "food", 100, []string{"bard", "bars", "fab", "foo"}},
+		{"bar", "barb", 100, []string{"bar"}},
+		{"bar", "bars", 100, []string{"barb", "bard", "bar"}},
+		{"a", "g", 2, []string{"barb", "bard"}},
+		{"bars", "bars", 100, nil},
+	}
+	for i, tt := range tests {
+		var end []byte
+		if tt.end != "" {
+			end = []byte(tt.end)
+		}
+		have := walk([]byte(tt.start), end, tt.limit)
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: keys mismatch: have %q, want %q", i, have, tt.want)
+		}
+	}
+	// Errors returned by the callback abort the walk
+	fail := errors.New("fail")
+	if err := trie.WalkRange(nil, nil, func(key, value []byte) (bool, error) { return true, fail }); err != fail {
+		t.Errorf("error mismatch: have %v, want %v", err, fail)
+	}
+}
+
+func TestDiffTries(t *testing.T) {
+	triedb := NewDatabase(memorydb.New())
+	commit := func(kvs []kvs) common.Hash {
+		trie, _ := New(common.Hash{}, triedb)
+		for _, val := range kvs {
+			trie.Update([]byte(val.k), []byte(val.v))
+		}
+		root, _ := trie.Commit(nil)
+		return root
+	}
+	rootA := commit(testdata1)
+	rootB := commit([]kvs{
+		{"barb", "ba"},
+		{"bard", "bc"},
+		{"bars", "changed"},
+		{"bar", "b"},
+		{"fab", "z"},
+		{"food", "ab"},
+		{"foo", "a"},
+		{"fooz", "new"},
+	})
+	changes, err := DiffTries(triedb, rootA, rootB)
+	if err != nil {
+		t.Fatalf("failed to diff tries: %v", err)
+	}
+	want := []TrieChange{
+		{Key: []byte("bars"), Old: []byte("bb"), New: []byte("changed")},
+		{Key: []byte("foos"), Old: []byte("aa")},
+		{Key: []byte("fooz"), New: []byte("new")},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes mismatch:\nhave %+v\nwant %+v", changes, want)
+	}
+	if changes, _ := DiffTries(triedb, rootA, rootA); len(changes) != 0 {
+		t.Errorf("identical tries differ: %+v", changes)
+	}
+}
+
+func TestIteratorSeekReuse(t *testing.T) {
+	trie := newEmpty()
+	for i := 0; i < 1000; i++ {
+		trie.Update(crypto.Keccak256([]byte{byte(i), byte(i >> 8)}), []byte{byte(i), byte(i >> 8)})
+	}
+	root, _ := trie.Commit(nil)
+	trie, _ = New(root, trie.db)
+
+	var keys [][]byte
+	for it := trie.Iterator(nil); it.Next(); {
+		keys = append(keys, common.CopyBytes(it.Key))
+	}
+	// Seek around on a single iterator, forwards and backwards, checking it
+	// continues exactly like a fresh iterator started at the cursor
+	it := trie.Iterator(nil)
+	for _, pos := range []int{500, 10, 11, 999, 0, 700, 250} {
+		for i := 0; i < 50 && it.Next(); i++ {
+		}
+		if err := it.Seek(keys[pos]); err != nil {
+			t.Fatalf("failed to seek: %v", err)
+		}
+		for i := pos; i < pos+100 && i < len(keys); i++ {
+			if !it.Next() {
+				t.Fatalf("seek to %d: iterator ended at %d: %v", pos, i, it.Err)
+			}
+			if !bytes.Equal(it.Key, keys[i]) {
+				t.Fatalf("seek to %d: key %d mismatch: have %x, want %x", pos, i, it.Key, keys[i])
+			}
+		}
+	}
+	// Seeking past the last key exhausts the iterator
+	it.Seek(bytes.Repeat([]byte{0xff}, 33))
+	if it.Next() {
+		t.Errorf("iterator yielded key %x past the end", it.Key)
+	}
+}
+
 func checkIteratorOrder(want []kvs, it *Iterator) error {
 	for it.Next() {
 		if len(want) == 0 {
@@ -18,7 +18,9 @@ package trie
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -27,6 +29,9 @@ import (
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
+// errCustomHashProof is returned by Prove on tries hashed by a custom function.
+var errCustomHashProof = errors.New("proofs of tries with a custom hash function are not supported")
+
 // Prove constructs a merkle proof for key. The result contains all encoded nodes
 // on the path to the value at key. The value itself is also included in the last
 // node and can be retrieved by verifying the proof.
@@ -35,8 +40,24 @@ import (
 // nodes of the longest existing prefix of the key (at least the root node), ending
 // with the node that proves the absence of the key.
 func (t *Trie) Prove(key []byte, fromLevel uint, proofDb ethdb.Writer) error {
-	// Collect all nodes on the path to key.
-	key = keybytesToHex(key)
+	// Proofs are keyed and verified by Keccak256 hashes
+	if t.hashFactory != nil {
+		return errCustomHashProof
+	}
+	nodes, _, err := t.provePath(key)
+	if err != nil {
+		return err
+	}
+	t.writeProof(nodes, fromLevel, proofDb)
+	return nil
+}
+
+// provePath collects the nodes on the path to key, along with the value at its
+// end if the trie contains key. Nodes resolved from the database on the way are
+// not kept in the trie.
+func (t *Trie) provePath(key []byte) ([]node, []byte, error) {
+	hexkey := keybytesToHex(key)
+	key = hexkey
 	var nodes []node
 	tn := t.root
 	for len(key) > 0 && tn != nil {
@@ -56,19 +77,37 @@ func (t *Trie) Prove(key []byte, fromLevel uint, proofDb ethdb.Writer) error {
 			nodes = append(nodes, n)
 		case hashNode:
 			var err error
-			tn, err = t.resolveHash(n, nil)
+			tn, err = t.resolveHash(n, hexkey[:len(hexkey)-len(key)])
 			if err != nil {
 				log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
-				return err
+				return nil, nil, err
 			}
 		default:
 			panic(fmt.Sprintf("%T: invalid node: %v", tn, tn))
 		}
 	}
+	value, _ := tn.(valueNode)
+	return nodes, value, nil
+}
+
+// writeProof encodes the nodes collected by provePath into proofDb, skipping
+// the first fromLevel proof elements.
+func (t *Trie) writeProof(nodes []node, fromLevel uint, proofDb ethdb.Writer) {
 	hasher := newHasher(nil)
 	defer returnHasherToPool(hasher)
 
 	for i, n := range nodes {
+		// Clean nodes with a cached hash might have their encoding cached too
+		if hash, _ := n.cache(); hash != nil {
+			if enc := t.encCache.get(hash); enc != nil {
+				if fromLevel > 0 {
+					fromLevel--
+				} else {
+					proofDb.Put(hash, enc)
+				}
+				continue
+			}
+		}
 		// Don't bother checking for errors here since hasher panics
 		// if encoding doesn't work and we're not writing to any database.
 		n, _, _ = hasher.hashChildren(n, nil)
@@ -83,10 +122,102 @@ func (t *Trie) Prove(key []byte, fromLevel uint, proofDb ethdb.Writer) error {
 				if !ok {
 					hash = crypto.Keccak256(enc)
 				}
+				t.encCache.add(hash, enc)
 				proofDb.Put(hash, enc)
 			}
 		}
 	}
+}
+
+// encodingCache is a size limited store of node RLP encodings keyed by the node
+// hash. Since the key is the hash of the value, entries never go stale and the
+// cache can be safely shared between copies of the same trie.
+type encodingCache struct {
+	encs  map[string][]byte
+	size  uint64 // Total byte size of the cached encodings
+	limit uint64 // Maximum byte size of the cached encodings
+
+	lock sync.RWMutex
+}
+
+// get retrieves the cached encoding of the node with the given hash, or nil if
+// it's not cached (or the cache is disabled).
+func (c *encodingCache) get(hash hashNode) []byte {
+	if c == nil {
+		return nil
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.encs[string(hash)]
+}
+
+// add inserts the encoding of a node into the cache, unless doing so would
+// exceed the cache's memory allowance.
+func (c *encodingCache) add(hash hashNode, enc []byte) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.encs[string(hash)]; ok {
+		return
+	}
+	size := uint64(len(hash) + len(enc))
+	if c.size+size > c.limit {
+		return
+	}
+	c.encs[string(hash)] = common.CopyBytes(enc)
+	c.size += size
+}
+
+// GetWithProof returns the value for key stored in the trie, along with the RLP
+// encoded nodes on the path from the root to it, ordered root first. If the trie
+// does not contain a value for key, the nodes prove its absence instead.
+// If a node was not found in the database, a MissingNodeError is returned.
+func (t *Trie) GetWithProof(key []byte) ([]byte, [][]byte, error) {
+	if t.hashFactory != nil {
+		return nil, nil, errCustomHashProof
+	}
+	path, value, err := t.provePath(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	var nodes proofList
+	t.writeProof(path, 0, &nodes)
+	return value, nodes, nil
+}
+
+// UpdateWithProof associates key with value in the trie like TryUpdate, and
+// returns the RLP encoded nodes proving the pre-state of key (its old value, or
+// its absence) against the previous root, along with the new root hash.
+// If a node was not found in the database, a MissingNodeError is returned and
+// the trie is left unmodified.
+func (t *Trie) UpdateWithProof(key, value []byte) ([][]byte, common.Hash, error) {
+	if t.frozen {
+		return nil, common.Hash{}, ErrFrozen
+	}
+	// Load the path into the trie first, so neither the proof nor the update
+	// have to resolve any of its nodes from the database
+	if _, err := t.TryGet(key); err != nil {
+		return nil, common.Hash{}, err
+	}
+	var nodes proofList
+	if err := t.Prove(key, 0, &nodes); err != nil {
+		return nil, common.Hash{}, err
+	}
+	if err := t.TryUpdate(key, value); err != nil {
+		return nil, common.Hash{}, err
+	}
+	return nodes, t.Hash(), nil
+}
+
+// proofList is a proof writer collecting the encoded nodes in order.
+type proofList [][]byte
+
+func (n *proofList) Put(key []byte, value []byte) error {
+	*n = append(*n, value)
 	return nil
 }
 
@@ -103,7 +234,8 @@ func (t *SecureTrie) Prove(key []byte, fromLevel uint, proofDb ethdb.Writer) err
 
 // VerifyProof checks merkle proofs. The given proof must contain the value for
 // key in a trie with the given root hash. VerifyProof returns an error if the
-// proof contains invalid trie nodes or the wrong value.
+// proof contains invalid trie nodes, nodes not matching the hash they are
+// referenced by, or the wrong value.
 func VerifyProof(rootHash common.Hash, key []byte, proofDb ethdb.Reader) (value []byte, nodes int, err error) {
 	key = keybytesToHex(key)
 	wantHash := rootHash
@@ -112,6 +244,9 @@ func VerifyProof(rootHash common.Hash, key []byte, proofDb ethdb.Reader) (value
 		if buf == nil {
 			return nil, i, fmt.Errorf("proof node %d (hash %064x) missing", i, wantHash)
 		}
+		if hash := crypto.Keccak256Hash(buf); hash != wantHash {
+			return nil, i, fmt.Errorf("proof node %d (hash %064x) mismatch: have %064x", i, wantHash, hash)
+		}
 		n, err := decodeNode(wantHash[:], buf)
 		if err != nil {
 			return nil, i, fmt.Errorf("bad proof node %d: %v", i, err)
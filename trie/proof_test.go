@@ -76,6 +76,144 @@ func TestProof(t *testing.T) {
 	}
 }
 
+// Tests that proofs generated with the node encoding cache enabled are identical
+// to the ones generated without, and that all cached encodings are valid.
+func TestProofEncodingCache(t *testing.T) {
+	trie, vals := randomTrie(500)
+	root := trie.Hash()
+
+	cached := *trie
+	cached.SetEncodingCache(1024 * 1024)
+	for i := 0; i < 2; i++ {
+		for _, kv := range vals {
+			want, have := memorydb.New(), memorydb.New()
+			trie.Prove(kv.k, 0, want)
+			cached.Prove(kv.k, 0, have)
+
+			if want.Len() != have.Len() {
+				t.Fatalf("proof size mismatch for key %x: have %d, want %d", kv.k, have.Len(), want.Len())
+			}
+			it := want.NewIterator()
+			for it.Next() {
+				if enc, _ := have.Get(it.Key()); !bytes.Equal(enc, it.Value()) {
+					t.Fatalf("proof node %x mismatch: have %x, want %x", it.Key(), enc, it.Value())
+				}
+			}
+			it.Release()
+
+			if val, _, err := VerifyProof(root, kv.k, have); err != nil || !bytes.Equal(val, kv.v) {
+				t.Fatalf("cached proof for key %x invalid: value %x, err %v", kv.k, val, err)
+			}
+		}
+	}
+	if len(cached.encCache.encs) == 0 {
+		t.Fatalf("encoding cache not populated")
+	}
+	for hash, enc := range cached.encCache.encs {
+		if have := crypto.Keccak256(enc); !bytes.Equal(have, []byte(hash)) {
+			t.Errorf("cached encoding hash mismatch: have %x, want %x", have, hash)
+		}
+	}
+}
+
+func TestGetWithProof(t *testing.T) {
+	trie, vals := randomTrie(500)
+	root := trie.Hash()
+	for _, kv := range vals {
+		value, nodes, err := trie.GetWithProof(kv.k)
+		if err != nil {
+			t.Fatalf("failed to get key %x: %v", kv.k, err)
+		}
+		if !bytes.Equal(value, kv.v) {
+			t.Fatalf("value mismatch for key %x: have %x, want %x", kv.k, value, kv.v)
+		}
+		proof := memorydb.New()
+		for _, node := range nodes {
+			proof.Put(crypto.Keccak256(node), node)
+		}
+		val, n, err := VerifyProof(root, kv.k, proof)
+		if err != nil {
+			t.Fatalf("failed to verify proof for key %x: %v", kv.k, err)
+		}
+		if !bytes.Equal(val, kv.v) {
+			t.Fatalf("verified value mismatch for key %x: have %x, want %x", kv.k, val, kv.v)
+		}
+		if n != len(nodes) {
+			t.Fatalf("proof node count mismatch for key %x: used %d, have %d", kv.k, n, len(nodes))
+		}
+	}
+	// Every node below the root must be resolved from the database only once
+	triedb := NewDatabase(memorydb.New())
+	stored, _ := New(common.Hash{}, triedb)
+	for _, kv := range vals {
+		stored.Update(kv.k, kv.v)
+	}
+	stored.Commit(nil)
+	for _, kv := range vals {
+		trie, _ := New(root, triedb)
+		trie.SetResolveTiming(true)
+		if _, nodes, err := trie.GetWithProof(kv.k); err != nil {
+			t.Fatalf("failed to get key %x from database: %v", kv.k, err)
+		} else if have := trie.ResolveLatency().Count; have != len(nodes)-1 {
+			t.Fatalf("resolved nodes mismatch for key %x: have %d, want %d", kv.k, have, len(nodes)-1)
+		}
+	}
+}
+
+func TestUpdateWithProof(t *testing.T) {
+	trie, vals := randomTrie(500)
+
+	var updated int
+	for _, kv := range vals {
+		if updated++; updated > 10 {
+			break
+		}
+		prevRoot := trie.Hash()
+		newValue := randBytes(20)
+
+		nodes, root, err := trie.UpdateWithProof(kv.k, newValue)
+		if err != nil {
+			t.Fatalf("failed to update key %x: %v", kv.k, err)
+		}
+		proof := memorydb.New()
+		for _, node := range nodes {
+			proof.Put(crypto.Keccak256(node), node)
+		}
+		val, _, err := VerifyProof(prevRoot, kv.k, proof)
+		if err != nil {
+			t.Fatalf("failed to verify pre-state proof for key %x: %v", kv.k, err)
+		}
+		if !bytes.Equal(val, kv.v) {
+			t.Fatalf("pre-state value mismatch for key %x: have %x, want %x", kv.k, val, kv.v)
+		}
+		kv.v = newValue
+
+		fresh := new(Trie)
+		for _, kv := range vals {
+			fresh.Update(kv.k, kv.v)
+		}
+		if want := fresh.Hash(); root != want {
+			t.Fatalf("post-state root mismatch: have %x, want %x", root, want)
+		}
+	}
+	// The path must be resolved from the database once for proof and update
+	triedb := NewDatabase(memorydb.New())
+	stored, _ := New(common.Hash{}, triedb)
+	for _, kv := range vals {
+		stored.Update(kv.k, kv.v)
+	}
+	root, _ := stored.Commit(nil)
+	for _, kv := range vals {
+		trie, _ := New(root, triedb)
+		trie.SetResolveTiming(true)
+		if nodes, _, err := trie.UpdateWithProof(kv.k, randBytes(20)); err != nil {
+			t.Fatalf("failed to update key %x in database: %v", kv.k, err)
+		} else if have := trie.ResolveLatency().Count; have != len(nodes)-1 {
+			t.Fatalf("resolved nodes mismatch for key %x: have %d, want %d", kv.k, have, len(nodes)-1)
+		}
+	}
+}
+
 func TestOneElementProof(t *testing.T) {
 	trie := new(Trie)
 	updateString(trie, "k", "v")
@@ -125,6 +263,41 @@ func TestBadProof(t *testing.T) {
 	}
 }
 
+// Tests that proof nodes whose content doesn't match the hash they are stored
+// under are rejected, even if they decode fine.
+func TestTamperedProof(t *testing.T) {
+	trie, vals := randomTrie(800)
+	root := trie.Hash()
+	for _, kv := range vals {
+		proof := memorydb.New()
+		trie.Prove(kv.k, 0, proof)
+
+		it := proof.NewIterator()
+		for i, d := 0, mrand.Intn(proof.Len()); i <= d; i++ {
+			it.Next()
+		}
+		key := it.Key()
+		val, _ := proof.Get(key)
+		it.Release()
+
+		// Swap the node for a valid one from another proof
+		other := memorydb.New()
+		trie.Prove(randBytes(32), 0, other)
+		it = other.NewIterator()
+		for it.Next() {
+			if !bytes.Equal(it.Value(), val) {
+				proof.Put(key, it.Value())
+				break
+			}
+		}
+		it.Release()
+
+		if _, _, err := VerifyProof(root, kv.k, proof); err == nil {
+			t.Fatalf("expected tampered proof to fail for key %x", kv.k)
+		}
+	}
+}
+
 // Tests that missing keys can also be proven. The test explicitly uses a single
 // entry trie and checks for missing keys both before and after the single entry.
 func TestMissingKeyProof(t *testing.T) {
@@ -148,6 +321,66 @@ func TestMissingKeyProof(t *testing.T) {
 	}
 }
 
+// Tests that exclusion proofs for keys diverging at a branch node carry the
+// branch with the empty slot, and that membership can't be forged.
+func TestBranchExclusionProof(t *testing.T) {
+	trie := new(Trie)
+	updateString(trie, "a", "v1")
+	updateString(trie, "c", "v2")
+	root := trie.Hash()
+
+	// "b" shares the first nibble with the other keys, diverging at the branch
+	proof := memorydb.New()
+	if err := trie.Prove([]byte("b"), 0, proof); err != nil {
+		t.Fatalf("failed to prove: %v", err)
+	}
+	val, _, err := VerifyProof(root, []byte("b"), proof)
+	if err != nil {
+		t.Fatalf("failed to verify exclusion proof: %v", err)
+	}
+	if val != nil {
+		t.Fatalf("exclusion proof yielded value %x", val)
+	}
+	// A membership proof from a trie filling the slot must not verify
+	forged := new(Trie)
+	updateString(forged, "a", "v1")
+	updateString(forged, "b", "v3")
+	updateString(forged, "c", "v2")
+
+	proof = memorydb.New()
+	forged.Prove([]byte("b"), 0, proof)
+	if _, _, err := VerifyProof(root, []byte("b"), proof); err == nil {
+		t.Fatalf("forged membership proof verified")
+	}
+}
+
+func TestMissingNodeProof(t *testing.T) {
+	diskdb := memorydb.New()
+	triedb := NewDatabase(diskdb)
+
+	trie, _ := New(common.Hash{}, triedb)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	root, _ := trie.Commit(nil)
+	triedb.Commit(root, false)
+
+	hash := common.HexToHash("0xe1d943cc8f061a0c0b98162830b970395ac9315654824bf21b73b891365262f9")
+	diskdb.Delete(hash[:])
+
+	trie, _ = New(root, NewDatabase(diskdb))
+	err := trie.Prove([]byte("120000"), 0, memorydb.New())
+	missing, ok := err.(*MissingNodeError)
+	if !ok {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if missing.NodeHash != hash {
+		t.Errorf("missing node mismatch: have %x, want %x", missing.NodeHash, hash)
+	}
+	if want := keybytesToHex([]byte("120000")); !bytes.HasPrefix(want, missing.Path) || len(missing.Path) == 0 {
+		t.Errorf("missing node path %x not a prefix of %x", missing.Path, want)
+	}
+}
+
 // mutateByte changes one byte in b.
 func mutateByte(b []byte) {
 	for r := mrand.Intn(len(b)); ; {
@@ -176,6 +409,25 @@ func BenchmarkProve(b *testing.B) {
 	}
 }
 
+func BenchmarkProveEncodingCache(b *testing.B) {
+	trie, vals := randomTrie(100)
+	trie.Hash()
+	trie.SetEncodingCache(1024 * 1024)
+
+	var keys []string
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		kv := vals[keys[i%len(keys)]]
+		proofs := memorydb.New()
+		if trie.Prove(kv.k, 0, proofs); proofs.Len() == 0 {
+			b.Fatalf("zero length proof for %x", kv.k)
+		}
+	}
+}
+
 func BenchmarkVerifyProof(b *testing.B) {
 	trie, vals := randomTrie(100)
 	root := trie.Hash()
@@ -52,10 +52,16 @@ type SecureTrie struct {
 // A new cache generation is created by each call to Commit.
 // cachelimit sets the number of past cache generations to keep.
 func NewSecure(root common.Hash, db *Database) (*SecureTrie, error) {
+	return NewSecureWithPrefix(root, nil, db)
+}
+
+// NewSecureWithPrefix creates a secure trie identified by the given prefix (e.g.
+// the hash of the account owning a storage trie), which is reported in errors.
+func NewSecureWithPrefix(root common.Hash, prefix []byte, db *Database) (*SecureTrie, error) {
 	if db == nil {
 		panic("trie.NewSecure called without a database")
 	}
-	trie, err := New(root, db)
+	trie, err := NewWithPrefix(root, prefix, db)
 	if err != nil {
 		return nil, err
 	}
@@ -172,6 +178,13 @@ func (t *SecureTrie) NodeIterator(start []byte) NodeIterator {
 	return t.trie.NodeIterator(start)
 }
 
+// Iterator returns a key-value iterator over the leaves of the underlying trie,
+// yielding the hashed keys in ascending order. Iteration starts at the given
+// (hashed) start key. Use GetKey to retrieve the preimages of the keys.
+func (t *SecureTrie) Iterator(start []byte) *Iterator {
+	return t.trie.Iterator(start)
+}
+
 // hashKey returns the hash of key as an ephemeral buffer.
 // The caller must not hold onto the return value because it will become
 // invalid on the next call to hashKey or secKey.
@@ -24,6 +24,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 )
 
@@ -105,6 +106,103 @@ func TestSecureGetKey(t *testing.T) {
 	}
 }
 
+// writeCountingDB is a key-value store counting the direct writes and the
+// batch flushes issued against it.
+type writeCountingDB struct {
+	ethdb.KeyValueStore
+	puts   int
+	writes int
+}
+
+func (db *writeCountingDB) Put(key []byte, value []byte) error {
+	db.puts++
+	return db.KeyValueStore.Put(key, value)
+}
+
+func (db *writeCountingDB) NewBatch() ethdb.Batch {
+	return &writeCountingBatch{Batch: db.KeyValueStore.NewBatch(), db: db}
+}
+
+type writeCountingBatch struct {
+	ethdb.Batch
+	db *writeCountingDB
+}
+
+func (b *writeCountingBatch) Write() error {
+	b.db.writes++
+	return b.Batch.Write()
+}
+
+// Tests that secure key preimages are buffered in memory and flushed to disk
+// in a single batch on commit, instead of one write per hashed key.
+func TestSecurePreimageBatching(t *testing.T) {
+	diskdb := &writeCountingDB{KeyValueStore: memorydb.New()}
+	triedb := NewDatabase(diskdb)
+	trie, _ := NewSecure(common.Hash{}, triedb)
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = common.LeftPadBytes([]byte{byte(i)}, 32)
+		trie.Update(keys[i], []byte{byte(i), 1})
+	}
+	root, err := trie.Commit(nil)
+	if err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	if err := triedb.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit database: %v", err)
+	}
+	if diskdb.puts != 0 {
+		t.Errorf("direct disk writes mismatch: have %d, want 0", diskdb.puts)
+	}
+	if diskdb.writes != 1 {
+		t.Errorf("batch flushes mismatch: have %d, want 1", diskdb.writes)
+	}
+	// Reopen the trie on a fresh database so preimages come from disk
+	trie, _ = NewSecure(root, NewDatabase(diskdb))
+	for _, key := range keys {
+		if have := trie.GetKey(crypto.Keccak256(key)); !bytes.Equal(have, key) {
+			t.Errorf("preimage mismatch: have %x, want %x", have, key)
+		}
+	}
+}
+
+func TestSecureIterator(t *testing.T) {
+	triedb, trie, content := makeTestSecureTrie()
+	root, _ := trie.Commit(nil)
+	triedb.Commit(root, false)
+
+	// Reopen the trie so that nodes are resolved lazily during iteration
+	trie, _ = NewSecure(root, NewDatabase(triedb.diskdb))
+
+	hashed := make(map[string][]byte)
+	for key, val := range content {
+		hashed[string(crypto.Keccak256([]byte(key)))] = val
+	}
+	var prev []byte
+	it := trie.Iterator(nil)
+	for it.Next() {
+		if prev != nil && bytes.Compare(prev, it.Key) >= 0 {
+			t.Fatalf("keys out of order: %x after %x", it.Key, prev)
+		}
+		prev = common.CopyBytes(it.Key)
+
+		if want, ok := hashed[string(it.Key)]; !ok || !bytes.Equal(it.Value, want) {
+			t.Fatalf("unexpected entry %x => %x", it.Key, it.Value)
+		}
+		if key := trie.GetKey(it.Key); !bytes.Equal(crypto.Keccak256(key), it.Key) {
+			t.Fatalf("preimage mismatch for %x: %x", it.Key, key)
+		}
+		delete(hashed, string(it.Key))
+	}
+	if it.Err != nil {
+		t.Fatalf("iteration failed: %v", it.Err)
+	}
+	if len(hashed) != 0 {
+		t.Fatalf("%d entries not iterated", len(hashed))
+	}
+}
+
 func TestSecureTrieConcurrency(t *testing.T) {
 	// Create an initial trie and copy if for concurrent access
 	_, trie, _ := makeTestSecureTrie()
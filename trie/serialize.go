@@ -0,0 +1,227 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Node tags of the binary trie serialization format. The low nibble of a tag
+// byte holds the node type, the high nibble the flags of structural nodes.
+const (
+	serialNil   = 0x00
+	serialShort = 0x01
+	serialFull  = 0x02
+	serialValue = 0x03
+	serialHash  = 0x04
+
+	serialCached = 0x10 // Node has a cached hash, stored right after the tag
+	serialDirty  = 0x20 // Node is dirty (not yet committed)
+)
+
+// serialVersion is the leading byte of serialized tries.
+const serialVersion = 0
+
+var errShortSerialization = errors.New("unexpected end of serialized trie")
+
+// MarshalBinary serializes the nodes of the trie currently held in memory into
+// a compact binary format, preserving cached hashes and dirty flags. Subtries
+// not yet resolved are stored as hashes, so deserializing them requires the
+// database the trie was loaded from.
+func (t *Trie) MarshalBinary() ([]byte, error) {
+	return appendSerialNode([]byte{serialVersion}, t.root), nil
+}
+
+func appendSerialNode(buf []byte, n node) []byte {
+	switch n := n.(type) {
+	case nil:
+		return append(buf, serialNil)
+	case *shortNode:
+		buf = appendSerialFlags(buf, serialShort, n.flags)
+		buf = appendSerialBytes(buf, n.Key)
+		return appendSerialNode(buf, n.Val)
+	case *fullNode:
+		buf = appendSerialFlags(buf, serialFull, n.flags)
+		for _, child := range &n.Children {
+			buf = appendSerialNode(buf, child)
+		}
+		return buf
+	case valueNode:
+		return appendSerialBytes(append(buf, serialValue), n)
+	case hashNode:
+		return appendSerialBytes(append(buf, serialHash), n)
+	default:
+		panic(fmt.Sprintf("%T: invalid node: %v", n, n))
+	}
+}
+
+func appendSerialFlags(buf []byte, tag byte, flags nodeFlag) []byte {
+	if flags.dirty {
+		tag |= serialDirty
+	}
+	if flags.hash != nil {
+		return appendSerialBytes(append(buf, tag|serialCached), flags.hash)
+	}
+	return append(buf, tag)
+}
+
+func appendSerialBytes(buf []byte, data []byte) []byte {
+	var size [binary.MaxVarintLen64]byte
+	buf = append(buf, size[:binary.PutUvarint(size[:], uint64(len(data)))]...)
+	return append(buf, data...)
+}
+
+// UnmarshalTrie deserializes a trie produced by MarshalBinary on top of the
+// given database, which is used to resolve the subtries stored as hashes.
+func UnmarshalTrie(data []byte, db *Database) (*Trie, error) {
+	if len(data) == 0 {
+		return nil, errShortSerialization
+	}
+	if data[0] != serialVersion {
+		return nil, fmt.Errorf("unsupported trie serialization version %d", data[0])
+	}
+	root, rest, err := decodeSerialNode(data[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes after serialized trie", len(rest))
+	}
+	if _, ok := root.(valueNode); ok {
+		return nil, errors.New("value node as trie root")
+	}
+	return &Trie{db: db, root: root}, nil
+}
+
+func decodeSerialNode(data []byte) (node, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errShortSerialization
+	}
+	tag, data := data[0], data[1:]
+
+	var (
+		flags nodeFlag
+		err   error
+	)
+	switch tag &^ (serialCached | serialDirty) {
+	case serialShort, serialFull:
+		flags.dirty = tag&serialDirty != 0
+		if tag&serialCached != 0 {
+			var hash []byte
+			if hash, data, err = decodeSerialBytes(data); err != nil {
+				return nil, nil, err
+			}
+			if len(hash) != hashLen {
+				return nil, nil, fmt.Errorf("invalid cached hash length %d", len(hash))
+			}
+			flags.hash = hash
+		}
+	default:
+		if tag&(serialCached|serialDirty) != 0 {
+			return nil, nil, fmt.Errorf("invalid flags on node tag %#x", tag)
+		}
+	}
+	switch tag &^ (serialCached | serialDirty) {
+	case serialNil:
+		return nil, data, nil
+
+	case serialShort:
+		key, data, err := decodeSerialBytes(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(key) == 0 {
+			return nil, nil, errors.New("short node with empty key")
+		}
+		for i, nibble := range key {
+			if nibble > 16 || (nibble == 16 && i != len(key)-1) {
+				return nil, nil, fmt.Errorf("invalid short node key nibble %d at %d", nibble, i)
+			}
+		}
+		val, data, err := decodeSerialNode(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Leaves hold a value, extensions a branch that is either loaded or not
+		switch val.(type) {
+		case valueNode:
+			if !hasTerm(key) {
+				return nil, nil, errors.New("short node with value child but no terminator")
+			}
+		case *fullNode, hashNode:
+			if hasTerm(key) {
+				return nil, nil, fmt.Errorf("short node with terminator but %T child", val)
+			}
+		default:
+			return nil, nil, fmt.Errorf("short node with invalid child %T", val)
+		}
+		return &shortNode{Key: key, Val: val, flags: flags}, data, nil
+
+	case serialFull:
+		var (
+			n     = &fullNode{flags: flags}
+			count int
+		)
+		for i := range &n.Children {
+			if n.Children[i], data, err = decodeSerialNode(data); err != nil {
+				return nil, nil, err
+			}
+			if n.Children[i] == nil {
+				continue
+			}
+			count++
+			if _, ok := n.Children[i].(valueNode); ok != (i == 16) {
+				return nil, nil, fmt.Errorf("full node with invalid child %T at %d", n.Children[i], i)
+			}
+		}
+		if count < 2 {
+			return nil, nil, fmt.Errorf("full node with %d children", count)
+		}
+		return n, data, nil
+
+	case serialValue:
+		val, data, err := decodeSerialBytes(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return valueNode(val), data, nil
+
+	case serialHash:
+		hash, data, err := decodeSerialBytes(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(hash) != hashLen {
+			return nil, nil, fmt.Errorf("invalid hash node length %d", len(hash))
+		}
+		return hashNode(hash), data, nil
+
+	default:
+		return nil, nil, fmt.Errorf("invalid node tag %#x", tag)
+	}
+}
+
+func decodeSerialBytes(data []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return nil, nil, errShortSerialization
+	}
+	data = data[n:]
+	return append([]byte{}, data[:size]...), data[size:], nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+func makeSerialTestTrie(n int) (*Trie, *Database) {
+	triedb := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, triedb)
+	for i := 0; i < n; i++ {
+		key := crypto.Keccak256([]byte{byte(i), byte(i >> 8)})
+		trie.Update(key, bytes.Repeat([]byte{byte(i)}, 1+i%40))
+	}
+	// Add some short keys to get embedded nodes and branch values too
+	for i := 0; i < 16; i++ {
+		trie.Update([]byte{byte(i)}, []byte{byte(i)})
+		trie.Update([]byte{byte(i), 0x01}, []byte{byte(i), 0x01})
+	}
+	return trie, triedb
+}
+
+func TestSerializeRoundtrip(t *testing.T) {
+	// Dirty, never hashed trie
+	trie, triedb := makeSerialTestTrie(1000)
+	testSerializeRoundtrip(t, trie, triedb)
+
+	// Hashed and committed trie, with cached hashes and clean flags
+	trie.Hash()
+	testSerializeRoundtrip(t, trie, triedb)
+	root, _ := trie.Commit(nil)
+	testSerializeRoundtrip(t, trie, triedb)
+
+	// Partially resolved trie, with subtries still referenced by hash
+	trie, _ = New(root, triedb)
+	trie.Get(crypto.Keccak256([]byte{1, 0}))
+	testSerializeRoundtrip(t, trie, triedb)
+
+	// Empty trie
+	testSerializeRoundtrip(t, newEmpty(), triedb)
+}
+
+func testSerializeRoundtrip(t *testing.T, trie *Trie, triedb *Database) {
+	blob, err := trie.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to serialize trie: %v", err)
+	}
+	loaded, err := UnmarshalTrie(blob, triedb)
+	if err != nil {
+		t.Fatalf("failed to deserialize trie: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.root, trie.root) {
+		t.Fatalf("tree shape mismatch")
+	}
+	if have, want := loaded.Hash(), trie.Hash(); have != want {
+		t.Fatalf("root mismatch: have %x, want %x", have, want)
+	}
+	for it := NewIterator(loaded.NodeIterator(nil)); it.Next(); {
+		if want := trie.Get(it.Key); !bytes.Equal(it.Value, want) {
+			t.Fatalf("value mismatch for %x: have %x, want %x", it.Key, it.Value, want)
+		}
+	}
+}
+
+func TestSerializeCorrupt(t *testing.T) {
+	trie, triedb := makeSerialTestTrie(100)
+	trie.Hash()
+	blob, _ := trie.MarshalBinary()
+
+	for i := 0; i < len(blob); i++ {
+		if _, err := UnmarshalTrie(blob[:i], triedb); err == nil {
+			t.Fatalf("truncated trie of %d/%d bytes accepted", i, len(blob))
+		}
+	}
+	if _, err := UnmarshalTrie(append(blob, 0x00), triedb); err == nil {
+		t.Errorf("trailing bytes accepted")
+	}
+	corrupt := common.CopyBytes(blob)
+	corrupt[0] = 0xff
+	if _, err := UnmarshalTrie(corrupt, triedb); err == nil {
+		t.Errorf("unknown version accepted")
+	}
+	corrupt = common.CopyBytes(blob)
+	corrupt[1] = 0x0f
+	if _, err := UnmarshalTrie(corrupt, triedb); err == nil {
+		t.Errorf("unknown node tag accepted")
+	}
+	// Structurally invalid trees must be rejected, not fail later on use
+	var (
+		leaf   = &shortNode{Key: []byte{1, 16}, Val: valueNode("v")}
+		branch = &fullNode{Children: [17]node{leaf, leaf}}
+	)
+	invalid := map[string]node{
+		"value root":              valueNode("v"),
+		"empty short key":         &shortNode{Key: []byte{}, Val: branch},
+		"terminator, no value":    &shortNode{Key: []byte{1, 16}, Val: branch},
+		"value, no terminator":    &shortNode{Key: []byte{1}, Val: valueNode("v")},
+		"inner terminator":        &shortNode{Key: []byte{1, 16, 2}, Val: valueNode("v")},
+		"short under short":       &shortNode{Key: []byte{1}, Val: leaf},
+		"value in branch slot":    &fullNode{Children: [17]node{valueNode("v"), leaf}},
+		"non-value in value slot": &fullNode{Children: [17]node{0: leaf, 16: leaf}},
+		"single child branch":     &fullNode{Children: [17]node{leaf}},
+		"childless branch":        &fullNode{},
+	}
+	for name, n := range invalid {
+		if _, err := UnmarshalTrie(appendSerialNode([]byte{serialVersion}, n), triedb); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	corrupt = append([]byte{serialVersion, serialShort, 3, 0, 1, 16, serialFull}, make([]byte, 17)...)
+	if _, err := UnmarshalTrie(corrupt, triedb); err == nil {
+		t.Errorf("leaf with branch child accepted")
+	}
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	trie, _ := makeSerialTestTrie(10000)
+	trie.Hash()
+	blob, _ := trie.MarshalBinary()
+
+	b.Run("marshal", func(b *testing.B) {
+		b.SetBytes(int64(len(blob)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			trie.MarshalBinary()
+		}
+	})
+	b.Run("unmarshal", func(b *testing.B) {
+		b.SetBytes(int64(len(blob)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			UnmarshalTrie(blob, nil)
+		}
+	})
+}
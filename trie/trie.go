@@ -20,6 +20,10 @@ package trie
 import (
 	"bytes"
 	"fmt"
+	"hash"
+	"sync"
+	"time"
+	"unsafe"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -39,14 +43,44 @@ var (
 // between account and storage tries.
 type LeafCallback func(leaf []byte, parent common.Hash) error
 
+// CommitCallback is a callback type invoked for every node written into the
+// trie database during commit, with the node's hash and RLP encoding. The blob
+// is an ephemeral buffer that must not be retained after the callback returns.
+type CommitCallback func(hash common.Hash, blob []byte)
+
 // Trie is a Merkle Patricia Trie.
 // The zero value is an empty trie with no database.
 // Use New to create a trie that sits on top of a database.
 //
 // Trie is not safe for concurrent use.
 type Trie struct {
-	db   *Database
-	root node
+	db      *Database
+	root    node
+	prefix  []byte // Optional prefix identifying the trie, reported in errors
+	frozen  bool   // Whether mutations are rejected with ErrFrozen
+	memonly bool   // Whether node resolution is disallowed (in-memory updates)
+
+	resolveTiming bool         // Whether to measure the latency of node resolutions
+	resolveStats  ResolveStats // Aggregate latency of the measured node resolutions
+
+	encCache    *encodingCache   // Optional cache of clean node encodings (nil = disabled)
+	commitHook  CommitCallback   // Optional callback for every node committed
+	hashFactory func() hash.Hash // Optional node hash function (nil = Keccak256)
+	hashStats   HashStats        // Node hashing statistics of the last Hash or Commit
+}
+
+// HashStats contains statistics about the nodes visited while hashing a trie.
+type HashStats struct {
+	Computed int // Number of nodes whose encoding and hash were recomputed
+	Cached   int // Number of nodes whose cached hash was reused
+}
+
+// ResolveStats contains aggregate statistics about the nodes a trie resolved
+// from its database.
+type ResolveStats struct {
+	Count int           // Number of nodes resolved
+	Total time.Duration // Total time spent resolving nodes
+	Max   time.Duration // Longest time spent resolving a single node
 }
 
 // newFlag returns the cache flag value for a newly created node.
@@ -61,13 +95,33 @@ func (t *Trie) newFlag() nodeFlag {
 // New will panic if db is nil and returns a MissingNodeError if root does
 // not exist in the database. Accessing the trie loads nodes from db on demand.
 func New(root common.Hash, db *Database) (*Trie, error) {
+	return NewWithPrefix(root, nil, db)
+}
+
+// NewWithPrefix creates a trie with an existing root node from db, identified
+// by the given prefix (e.g. the hash of the account owning a storage trie). The
+// prefix is only used to give context to the errors returned by the trie.
+func NewWithPrefix(root common.Hash, prefix []byte, db *Database) (*Trie, error) {
+	return newTrie(root, prefix, db, nil)
+}
+
+// NewWithHashFactory creates a trie with an existing root node from db, hashing
+// its nodes with the given function (see SetHashFactory). The root must have
+// been committed using the same function, including the root of an empty trie.
+func NewWithHashFactory(root common.Hash, db *Database, factory func() hash.Hash) (*Trie, error) {
+	return newTrie(root, nil, db, factory)
+}
+
+func newTrie(root common.Hash, prefix []byte, db *Database, factory func() hash.Hash) (*Trie, error) {
 	if db == nil {
 		panic("trie.New called without a database")
 	}
 	trie := &Trie{
-		db: db,
+		db:          db,
+		prefix:      common.CopyBytes(prefix),
+		hashFactory: factory,
 	}
-	if root != (common.Hash{}) && root != emptyRoot {
+	if root != (common.Hash{}) && root != trie.emptyHash() {
 		rootnode, err := trie.resolveHash(root[:], nil)
 		if err != nil {
 			return nil, err
@@ -77,12 +131,226 @@ func New(root common.Hash, db *Database) (*Trie, error) {
 	return trie, nil
 }
 
+// Freeze marks the trie as immutable. Any subsequent mutation attempt fails
+// with ErrFrozen, whereas reads (which may still resolve nodes from the
+// database) remain allowed. It is meant to guard tries that are cached for
+// later reuse against accidental modification.
+func (t *Trie) Freeze() {
+	t.frozen = true
+}
+
+// Unfreeze makes a previously frozen trie mutable again.
+func (t *Trie) Unfreeze() {
+	t.frozen = false
+}
+
+// Frozen returns whether the trie currently rejects mutations.
+func (t *Trie) Frozen() bool {
+	return t.frozen
+}
+
+// SetEncodingCache enables caching the RLP encodings of clean nodes, so that
+// repeated proof generation over overlapping paths doesn't need to re-encode
+// them. The cache holds at most the given number of bytes, zero disables it.
+func (t *Trie) SetEncodingCache(bytes uint64) {
+	if bytes == 0 {
+		t.encCache = nil
+		return
+	}
+	t.encCache = &encodingCache{
+		encs:  make(map[string][]byte),
+		limit: bytes,
+	}
+}
+
+// SetCommitHook registers a callback to be invoked for every node written into
+// the trie database by Commit, allowing newly finalized nodes to be mirrored
+// into a secondary store without re-walking the trie. A nil hook disables it.
+func (t *Trie) SetCommitHook(hook CommitCallback) {
+	t.commitHook = hook
+}
+
+// CountNodesByType counts the nodes currently held in memory by type, keyed by
+// "short", "full", "value" and "hash". Unresolved subtries only count as a
+// single hash node, nothing is loaded from the database.
+func (t *Trie) CountNodesByType() map[string]int {
+	counts := make(map[string]int)
+	countNodes(t.root, counts)
+	return counts
+}
+
+func countNodes(n node, counts map[string]int) {
+	switch n := n.(type) {
+	case *shortNode:
+		counts["short"]++
+		countNodes(n.Val, counts)
+	case *fullNode:
+		counts["full"]++
+		for _, child := range &n.Children {
+			countNodes(child, counts)
+		}
+	case valueNode:
+		counts["value"]++
+	case hashNode:
+		counts["hash"]++
+	}
+}
+
+// EstimateMemory returns the approximate number of bytes used by the nodes
+// currently held in memory: the node structs themselves plus the keys, values
+// and hashes they reference. Unresolved subtries only count their hash.
+func (t *Trie) EstimateMemory() int {
+	return estimateMemory(t.root)
+}
+
+var (
+	shortNodeSize = int(unsafe.Sizeof(shortNode{}))
+	fullNodeSize  = int(unsafe.Sizeof(fullNode{}))
+)
+
+func estimateMemory(n node) int {
+	switch n := n.(type) {
+	case *shortNode:
+		return shortNodeSize + len(n.Key) + len(n.flags.hash) + estimateMemory(n.Val)
+	case *fullNode:
+		size := fullNodeSize + len(n.flags.hash)
+		for _, child := range &n.Children {
+			size += estimateMemory(child)
+		}
+		return size
+	case valueNode:
+		return len(n)
+	case hashNode:
+		return len(n)
+	default:
+		return 0
+	}
+}
+
+// SetHashFactory replaces Keccak256 as the function hashing the trie nodes,
+// for experimenting with alternative hash functions. The function must produce
+// 32 byte hashes. It only applies to hashing and committing the trie: Prove
+// refuses to run on such a trie, sync and secure key hashing still use
+// Keccak256. Passing nil restores the default.
+//
+// The factory should be set on an empty trie, nodes hashed before the change
+// keep their cached hashes. Committed tries are reopened by passing the same
+// factory to NewWithHashFactory.
+func (t *Trie) SetHashFactory(factory func() hash.Hash) {
+	t.hashFactory = factory
+}
+
+// emptyHash returns the root hash of an empty trie under the trie's hash
+// function.
+func (t *Trie) emptyHash() common.Hash {
+	if t.hashFactory == nil {
+		return emptyRoot
+	}
+	return common.BytesToHash(newCustomHasher(nil, t.hashFactory).makeHashNode(emptyStringRLP))
+}
+
+// SetResolveTiming enables or disables measuring how long each node resolution
+// from the database takes, aggregating the results into ResolveLatency. The
+// statistics are reset whenever timing is enabled.
+//
+// Timing must not be enabled on a trie shared by a ConcurrentTrie, since
+// concurrent reads would race on the statistics.
+func (t *Trie) SetResolveTiming(enabled bool) {
+	t.resolveTiming = enabled
+	if enabled {
+		t.resolveStats = ResolveStats{}
+	}
+}
+
+// ResolveLatency returns the aggregate latency of the node resolutions measured
+// since timing was last enabled.
+func (t *Trie) ResolveLatency() ResolveStats {
+	return t.resolveStats
+}
+
 // NodeIterator returns an iterator that returns nodes of the trie. Iteration starts at
 // the key after the given start key.
 func (t *Trie) NodeIterator(start []byte) NodeIterator {
 	return newNodeIterator(t, start)
 }
 
+// NodeIteratorRange returns an iterator over the trie nodes holding keys in
+// the half-open range [start, end). A nil end leaves the range unbounded.
+// Subtrees entirely beyond end are never loaded from the database.
+func (t *Trie) NodeIteratorRange(start, end []byte) NodeIterator {
+	return newRangeNodeIterator(t, start, end)
+}
+
+// Iterator returns a key-value iterator over the leaves of the trie, assembling
+// the full keys of the entries. Iteration starts at the given start key.
+func (t *Trie) Iterator(start []byte) *Iterator {
+	return NewIterator(t.NodeIterator(start))
+}
+
+// WalkRange calls f for every key in the half-open range [start, end), in
+// iteration order (ascending, except that a key comes after the keys it is a
+// prefix of). A nil end leaves the range unbounded. The walk stops
+// as soon as f returns false or an error, and the error is passed on.
+func (t *Trie) WalkRange(start, end []byte, f func(key, value []byte) (bool, error)) error {
+	it := NewIterator(t.NodeIteratorRange(start, end))
+	for it.Next() {
+		// Seeking may still yield keys that are a prefix of start
+		if bytes.Compare(it.Key, start) < 0 {
+			continue
+		}
+		if next, err := f(it.Key, it.Value); err != nil || !next {
+			return err
+		}
+	}
+	return it.Err
+}
+
+// EmbeddedStats walks the whole trie, resolving it from the database, and
+// counts how many child nodes are embedded in their parent versus referenced
+// by hash. Embedded nodes don't need a separate database read to load.
+func (t *Trie) EmbeddedStats() (embedded, referenced int, err error) {
+	it := t.NodeIterator(nil)
+	for it.Next(true) {
+		if it.Leaf() || len(it.Path()) == 0 {
+			continue
+		}
+		if it.Hash() == (common.Hash{}) {
+			embedded++
+		} else {
+			referenced++
+		}
+	}
+	return embedded, referenced, it.Error()
+}
+
+// ContainsHash searches the trie for a node with the given hash, returning
+// whether it is reachable from the root and if so its hex encoded path.
+//
+// A hash says nothing about where its node sits in the trie, so the search is a
+// full node walk: every lookup of an absent hash costs O(n) in the size of the
+// trie and resolves all of it from the database. Don't use it on large tries
+// outside of debugging.
+//
+// Embedded and value nodes have no hash, so the zero hash is never found.
+func (t *Trie) ContainsHash(hash common.Hash) (bool, []byte, error) {
+	if hash == (common.Hash{}) {
+		return false, nil, nil
+	}
+	it := t.NodeIterator(nil)
+	for it.Next(true) {
+		if it.Hash() == hash {
+			return true, common.CopyBytes(it.Path()), nil
+		}
+	}
+	return false, nil, it.Error()
+}
+
+// IsEmpty reports whether the trie has no entries. Tries opened at the empty
+// root and tries that had all their entries deleted are both empty.
+func (t *Trie) IsEmpty() bool {
+	return t.root == nil
+}
+
 // Get returns the value for key stored in the trie.
 // The value bytes must not be modified by the caller.
 func (t *Trie) Get(key []byte) []byte {
@@ -161,7 +429,11 @@ func (t *Trie) Update(key, value []byte) {
 // stored in the trie.
 //
 // If a node was not found in the database, a MissingNodeError is returned.
+// If the trie is frozen, ErrFrozen is returned.
 func (t *Trie) TryUpdate(key, value []byte) error {
+	if t.frozen {
+		return ErrFrozen
+	}
 	k := keybytesToHex(key)
 	if len(value) != 0 {
 		_, n, err := t.insert(t.root, nil, k, valueNode(value))
@@ -170,7 +442,7 @@ func (t *Trie) TryUpdate(key, value []byte) error {
 		}
 		t.root = n
 	} else {
-		_, n, err := t.delete(t.root, nil, k)
+		_, n, _, err := t.delete(t.root, nil, k)
 		if err != nil {
 			return err
 		}
@@ -179,12 +451,92 @@ func (t *Trie) TryUpdate(key, value []byte) error {
 	return nil
 }
 
+// TryUpdateInfo is like TryUpdate, but also reports whether the trie changed
+// and whether the change was structural. Replacing the value of an existing
+// key is not structural: only the hashes along its path need recomputing.
+// Adding a new key or deleting an existing one adds or removes nodes.
+func (t *Trie) TryUpdateInfo(key, value []byte) (changed, restructured bool, err error) {
+	if t.frozen {
+		return false, false, ErrFrozen
+	}
+	k := keybytesToHex(key)
+	if len(value) != 0 {
+		changed, restructured, n, err := t.insertInfo(t.root, nil, k, valueNode(value))
+		if err != nil {
+			return false, false, err
+		}
+		t.root = n
+		return changed, restructured, nil
+	}
+	changed, n, _, err := t.delete(t.root, nil, k)
+	if err != nil {
+		return false, false, err
+	}
+	t.root = n
+	return changed, changed, nil
+}
+
+// TryUpdateBatch associates each of the keys with the value at the same index,
+// with empty values deleting the key, as if TryUpdate was called for each pair
+// in order. The batch is applied atomically: if any update fails, the trie is
+// left unmodified. Nodes resolved by earlier updates are reused by later ones
+// and the trie is only hashed when the caller requests the root.
+//
+// If a node was not found in the database, a MissingNodeError is returned.
+// If the trie is frozen, ErrFrozen is returned.
+func (t *Trie) TryUpdateBatch(keys, values [][]byte) error {
+	if t.frozen {
+		return ErrFrozen
+	}
+	if len(keys) != len(values) {
+		return fmt.Errorf("batch size mismatch: %d keys, %d values", len(keys), len(values))
+	}
+	root := t.root
+	for i, key := range keys {
+		var err error
+		if k := keybytesToHex(key); len(values[i]) != 0 {
+			_, root, err = t.insert(root, nil, k, valueNode(values[i]))
+		} else {
+			_, root, _, err = t.delete(root, nil, k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	t.root = root
+	return nil
+}
+
+// UpdateInMemory attempts to associate key with value in the trie without
+// loading any nodes from the database. If the update can be applied using only
+// the nodes already resident in memory, it is done and true is returned.
+// Otherwise (or if the trie is frozen) the trie is left untouched and false is
+// returned, allowing the caller to batch up the required resolutions.
+func (t *Trie) UpdateInMemory(key, value []byte) bool {
+	if t.frozen {
+		return false
+	}
+	t.memonly = true
+	defer func() { t.memonly = false }()
+
+	return t.TryUpdate(key, value) == nil
+}
+
 func (t *Trie) insert(n node, prefix, key []byte, value node) (bool, node, error) {
+	dirty, _, nn, err := t.insertInfo(n, prefix, key, value)
+	return dirty, nn, err
+}
+
+// insertInfo is insert, also reporting whether the insertion changed the trie's
+// structure by creating a new leaf or splitting a short node, rather than only
+// replacing an existing value.
+func (t *Trie) insertInfo(n node, prefix, key []byte, value node) (bool, bool, node, error) {
 	if len(key) == 0 {
 		if v, ok := n.(valueNode); ok {
-			return !bytes.Equal(v, value.(valueNode)), value, nil
+			return !bytes.Equal(v, value.(valueNode)), false, value, nil
 		}
-		return true, value, nil
+		// A new value in a branch slot, the key didn't exist yet
+		return true, true, value, nil
 	}
 	switch n := n.(type) {
 	case *shortNode:
@@ -192,42 +544,42 @@ func (t *Trie) insert(n node, prefix, key []byte, value node) (bool, node, error
 		// If the whole key matches, keep this short node as is
 		// and only update the value.
 		if matchlen == len(n.Key) {
-			dirty, nn, err := t.insert(n.Val, append(prefix, key[:matchlen]...), key[matchlen:], value)
+			dirty, restructured, nn, err := t.insertInfo(n.Val, append(prefix, key[:matchlen]...), key[matchlen:], value)
 			if !dirty || err != nil {
-				return false, n, err
+				return false, false, n, err
 			}
-			return true, &shortNode{n.Key, nn, t.newFlag()}, nil
+			return true, restructured, &shortNode{n.Key, nn, t.newFlag()}, nil
 		}
 		// Otherwise branch out at the index where they differ.
 		branch := &fullNode{flags: t.newFlag()}
 		var err error
 		_, branch.Children[n.Key[matchlen]], err = t.insert(nil, append(prefix, n.Key[:matchlen+1]...), n.Key[matchlen+1:], n.Val)
 		if err != nil {
-			return false, nil, err
+			return false, false, nil, err
 		}
 		_, branch.Children[key[matchlen]], err = t.insert(nil, append(prefix, key[:matchlen+1]...), key[matchlen+1:], value)
 		if err != nil {
-			return false, nil, err
+			return false, false, nil, err
 		}
 		// Replace this shortNode with the branch if it occurs at index 0.
 		if matchlen == 0 {
-			return true, branch, nil
+			return true, true, branch, nil
 		}
 		// Otherwise, replace it with a short node leading up to the branch.
-		return true, &shortNode{key[:matchlen], branch, t.newFlag()}, nil
+		return true, true, &shortNode{key[:matchlen], branch, t.newFlag()}, nil
 
 	case *fullNode:
-		dirty, nn, err := t.insert(n.Children[key[0]], append(prefix, key[0]), key[1:], value)
+		dirty, restructured, nn, err := t.insertInfo(n.Children[key[0]], append(prefix, key[0]), key[1:], value)
 		if !dirty || err != nil {
-			return false, n, err
+			return false, false, n, err
 		}
 		n = n.copy()
 		n.flags = t.newFlag()
 		n.Children[key[0]] = nn
-		return true, n, nil
+		return true, restructured, n, nil
 
 	case nil:
-		return true, &shortNode{key, value, t.newFlag()}, nil
+		return true, true, &shortNode{key, value, t.newFlag()}, nil
 
 	case hashNode:
 		// We've hit a part of the trie that isn't loaded yet. Load
@@ -235,13 +587,13 @@ func (t *Trie) insert(n node, prefix, key []byte, value node) (bool, node, error
 		// the path to the value in the trie.
 		rn, err := t.resolveHash(n, prefix)
 		if err != nil {
-			return false, nil, err
+			return false, false, nil, err
 		}
-		dirty, nn, err := t.insert(rn, prefix, key, value)
+		dirty, restructured, nn, err := t.insertInfo(rn, prefix, key, value)
 		if !dirty || err != nil {
-			return false, rn, err
+			return false, false, rn, err
 		}
-		return true, nn, nil
+		return true, restructured, nn, nil
 
 	default:
 		panic(fmt.Sprintf("%T: invalid node: %v", n, n))
@@ -257,9 +609,13 @@ func (t *Trie) Delete(key []byte) {
 
 // TryDelete removes any existing value for key from the trie.
 // If a node was not found in the database, a MissingNodeError is returned.
+// If the trie is frozen, ErrFrozen is returned.
 func (t *Trie) TryDelete(key []byte) error {
+	if t.frozen {
+		return ErrFrozen
+	}
 	k := keybytesToHex(key)
-	_, n, err := t.delete(t.root, nil, k)
+	_, n, _, err := t.delete(t.root, nil, k)
 	if err != nil {
 		return err
 	}
@@ -267,26 +623,49 @@ func (t *Trie) TryDelete(key []byte) error {
 	return nil
 }
 
-// delete returns the new root of the trie with key deleted.
+// DeleteAndGet removes any existing value for key from the trie, returning the
+// removed value and whether the key was present, within a single traversal.
+// If a node was not found in the database, a MissingNodeError is returned.
+// If the trie is frozen, ErrFrozen is returned.
+func (t *Trie) DeleteAndGet(key []byte) (oldValue []byte, existed bool, err error) {
+	if t.frozen {
+		return nil, false, ErrFrozen
+	}
+	k := keybytesToHex(key)
+	existed, n, old, err := t.delete(t.root, nil, k)
+	if err != nil {
+		return nil, false, err
+	}
+	t.root = n
+	return old, existed, nil
+}
+
+// delete returns the new root of the trie with key deleted, along with the
+// value that was removed (nil if the key was not present).
 // It reduces the trie to minimal form by simplifying
 // nodes on the way up after deleting recursively.
-func (t *Trie) delete(n node, prefix, key []byte) (bool, node, error) {
+func (t *Trie) delete(n node, prefix, key []byte) (bool, node, valueNode, error) {
 	switch n := n.(type) {
 	case *shortNode:
 		matchlen := prefixLen(key, n.Key)
 		if matchlen < len(n.Key) {
-			return false, n, nil // don't replace n on mismatch
+			return false, n, nil, nil // don't replace n on mismatch
 		}
 		if matchlen == len(key) {
-			return true, nil, nil // remove n entirely for whole matches
+			// Remove n entirely for whole matches, which must end in a value
+			val, ok := n.Val.(valueNode)
+			if !ok {
+				return false, n, nil, fmt.Errorf("invalid leaf at %x: %T child", append(prefix, n.Key...), n.Val)
+			}
+			return true, nil, val, nil
 		}
 		// The key is longer than n.Key. Remove the remaining suffix
 		// from the subtrie. Child can never be nil here since the
 		// subtrie must contain at least two other values with keys
 		// longer than n.Key.
-		dirty, child, err := t.delete(n.Val, append(prefix, key[:len(n.Key)]...), key[len(n.Key):])
+		dirty, child, old, err := t.delete(n.Val, append(prefix, key[:len(n.Key)]...), key[len(n.Key):])
 		if !dirty || err != nil {
-			return false, n, err
+			return false, n, nil, err
 		}
 		switch child := child.(type) {
 		case *shortNode:
@@ -296,15 +675,15 @@ func (t *Trie) delete(n node, prefix, key []byte) (bool, node, error) {
 			// always creates a new slice) instead of append to
 			// avoid modifying n.Key since it might be shared with
 			// other nodes.
-			return true, &shortNode{concat(n.Key, child.Key...), child.Val, t.newFlag()}, nil
+			return true, &shortNode{concat(n.Key, child.Key...), child.Val, t.newFlag()}, old, nil
 		default:
-			return true, &shortNode{n.Key, child, t.newFlag()}, nil
+			return true, &shortNode{n.Key, child, t.newFlag()}, old, nil
 		}
 
 	case *fullNode:
-		dirty, nn, err := t.delete(n.Children[key[0]], append(prefix, key[0]), key[1:])
+		dirty, nn, old, err := t.delete(n.Children[key[0]], append(prefix, key[0]), key[1:])
 		if !dirty || err != nil {
-			return false, n, err
+			return false, n, nil, err
 		}
 		n = n.copy()
 		n.flags = t.newFlag()
@@ -340,25 +719,25 @@ func (t *Trie) delete(n node, prefix, key []byte) (bool, node, error) {
 				// check.
 				cnode, err := t.resolve(n.Children[pos], prefix)
 				if err != nil {
-					return false, nil, err
+					return false, nil, nil, err
 				}
 				if cnode, ok := cnode.(*shortNode); ok {
 					k := append([]byte{byte(pos)}, cnode.Key...)
-					return true, &shortNode{k, cnode.Val, t.newFlag()}, nil
+					return true, &shortNode{k, cnode.Val, t.newFlag()}, old, nil
 				}
 			}
 			// Otherwise, n is replaced by a one-nibble short node
 			// containing the child.
-			return true, &shortNode{[]byte{byte(pos)}, n.Children[pos], t.newFlag()}, nil
+			return true, &shortNode{[]byte{byte(pos)}, n.Children[pos], t.newFlag()}, old, nil
 		}
 		// n still contains at least two values and cannot be reduced.
-		return true, n, nil
+		return true, n, old, nil
 
 	case valueNode:
-		return true, nil, nil
+		return true, nil, n, nil
 
 	case nil:
-		return false, nil, nil
+		return false, nil, nil, nil
 
 	case hashNode:
 		// We've hit a part of the trie that isn't loaded yet. Load
@@ -366,13 +745,13 @@ func (t *Trie) delete(n node, prefix, key []byte) (bool, node, error) {
 		// the path to the value in the trie.
 		rn, err := t.resolveHash(n, prefix)
 		if err != nil {
-			return false, nil, err
+			return false, nil, nil, err
 		}
-		dirty, nn, err := t.delete(rn, prefix, key)
+		dirty, nn, old, err := t.delete(rn, prefix, key)
 		if !dirty || err != nil {
-			return false, rn, err
+			return false, rn, nil, err
 		}
-		return true, nn, nil
+		return true, nn, old, nil
 
 	default:
 		panic(fmt.Sprintf("%T: invalid node: %v (%v)", n, n, key))
@@ -394,18 +773,54 @@ func (t *Trie) resolve(n node, prefix []byte) (node, error) {
 }
 
 func (t *Trie) resolveHash(n hashNode, prefix []byte) (node, error) {
+	if t.memonly {
+		return nil, errNotResident
+	}
+	if t.resolveTiming {
+		defer func(start time.Time) {
+			elapsed := time.Since(start)
+
+			t.resolveStats.Count++
+			t.resolveStats.Total += elapsed
+			if elapsed > t.resolveStats.Max {
+				t.resolveStats.Max = elapsed
+			}
+		}(time.Now())
+	}
 	hash := common.BytesToHash(n)
-	if node := t.db.node(hash); node != nil {
+	if node, size := t.db.node(hash); node != nil {
+		// Nodes encoding to less than a hash are embedded into their parent,
+		// only the root node may be referenced by hash regardless of its size.
+		if len(prefix) > 0 && size < hashLen {
+			return nil, ErrEmbeddedNodeReferenced
+		}
 		return node, nil
 	}
-	return nil, &MissingNodeError{NodeHash: hash, Path: prefix}
+	return nil, &MissingNodeError{NodeHash: hash, Path: prefix, Prefix: t.prefix}
 }
 
 // Hash returns the root hash of the trie. It does not write to the
 // database and can be used even if the trie doesn't have one.
 func (t *Trie) Hash() common.Hash {
-	hash, cached, _ := t.hashRoot(nil, nil)
-	t.root = cached
+	hash, cached, stats, _ := t.hashRoot(nil, nil)
+	t.root, t.hashStats = cached, stats
+	return common.BytesToHash(hash.(hashNode))
+}
+
+// HashParallel returns the same root hash as Hash, but hashes the subtrees
+// below the root concurrently on up to workers goroutines. It pays off when
+// many dirty nodes are spread across the trie, e.g. after a large batch of
+// updates.
+func (t *Trie) HashParallel(workers int) common.Hash {
+	if t.hashFactory != nil {
+		return t.Hash()
+	}
+	if t.IsEmpty() {
+		t.hashStats = HashStats{}
+		return emptyRoot
+	}
+	hash, cached, stats := hashParallel(t.root, workers)
+	t.root, t.hashStats = cached, stats
 	return common.BytesToHash(hash.(hashNode))
 }
 
@@ -415,19 +830,125 @@ func (t *Trie) Commit(onleaf LeafCallback) (root common.Hash, err error) {
 	if t.db == nil {
 		panic("commit called on trie with nil database")
 	}
-	hash, cached, err := t.hashRoot(t.db, onleaf)
+	hash, cached, stats, err := t.hashRoot(t.db, onleaf)
 	if err != nil {
 		return common.Hash{}, err
 	}
-	t.root = cached
+	t.root, t.hashStats = cached, stats
 	return common.BytesToHash(hash.(hashNode)), nil
 }
 
-func (t *Trie) hashRoot(db *Database, onleaf LeafCallback) (node, node, error) {
-	if t.root == nil {
-		return hashNode(emptyRoot.Bytes()), nil, nil
+func (t *Trie) hashRoot(db *Database, onleaf LeafCallback) (node, node, HashStats, error) {
+	if t.IsEmpty() {
+		return hashNode(t.emptyHash().Bytes()), nil, HashStats{}, nil
+	}
+	var h *hasher
+	if t.hashFactory == nil {
+		h = newHasher(onleaf)
+		defer returnHasherToPool(h)
+	} else {
+		h = newCustomHasher(onleaf, t.hashFactory)
+	}
+	if db != nil {
+		h.oncommit = t.commitHook
+	}
+	hashed, cached, err := h.hash(t.root, db, true)
+	return hashed, cached, h.stats, err
+}
+
+// HashStats returns how many nodes the last Hash, HashParallel or Commit
+// recomputed and how many it served from their cached hashes. After an update, only the nodes on
+// the path to the updated key should need recomputing.
+func (t *Trie) HashStats() HashStats {
+	return t.hashStats
+}
+
+// ConcurrentTrie wraps a Trie to make it safe for concurrent use. Get, TryGet,
+// Hash and NodeIterator only acquire a read lock and may run in parallel with
+// each other, whereas Update, TryUpdate, Delete and TryDelete are serialized by
+// a write lock.
+//
+// Reads resolving nodes from the database don't cache them in the wrapped trie
+// (that would mutate it under a read lock), so repeated reads of unloaded paths
+// hit the database (or its clean cache) every time.
+type ConcurrentTrie struct {
+	trie *Trie
+	lock sync.RWMutex
+}
+
+// NewConcurrent wraps trie for concurrent use. The caller must not access trie
+// directly afterwards.
+func NewConcurrent(trie *Trie) *ConcurrentTrie {
+	return &ConcurrentTrie{trie: trie}
+}
+
+// Get returns the value for key stored in the trie.
+// The value bytes must not be modified by the caller.
+func (t *ConcurrentTrie) Get(key []byte) []byte {
+	res, err := t.TryGet(key)
+	if err != nil {
+		log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
 	}
-	h := newHasher(onleaf)
-	defer returnHasherToPool(h)
-	return h.hash(t.root, db, true)
+	return res
+}
+
+// TryGet returns the value for key stored in the trie.
+// The value bytes must not be modified by the caller.
+// If a node was not found in the database, a MissingNodeError is returned.
+func (t *ConcurrentTrie) TryGet(key []byte) ([]byte, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	value, _, _, err := t.trie.tryGet(t.trie.root, keybytesToHex(key), 0)
+	return value, err
+}
+
+// Hash returns the root hash of the trie. The computed hashes are not cached
+// in the wrapped trie.
+func (t *ConcurrentTrie) Hash() common.Hash {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	hash, _, _, _ := t.trie.hashRoot(nil, nil)
+	return common.BytesToHash(hash.(hashNode))
+}
+
+// NodeIterator returns an iterator over a snapshot of the trie taken at the
+// time of the call. Iteration starts at the key after the given start key.
+func (t *ConcurrentTrie) NodeIterator(start []byte) NodeIterator {
+	t.lock.RLock()
+	snapshot := *t.trie
+	t.lock.RUnlock()
+
+	return snapshot.NodeIterator(start)
+}
+
+// Update associates key with value in the trie, see Trie.Update.
+func (t *ConcurrentTrie) Update(key, value []byte) {
+	if err := t.TryUpdate(key, value); err != nil {
+		log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
+	}
+}
+
+// TryUpdate associates key with value in the trie, see Trie.TryUpdate.
+func (t *ConcurrentTrie) TryUpdate(key, value []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.trie.TryUpdate(key, value)
+}
+
+// Delete removes any existing value for key from the trie.
+func (t *ConcurrentTrie) Delete(key []byte) {
+	if err := t.TryDelete(key); err != nil {
+		log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
+	}
+}
+
+// TryDelete removes any existing value for key from the trie, see Trie.TryDelete.
+func (t *ConcurrentTrie) TryDelete(key []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.trie.TryDelete(key)
 }
@@ -18,6 +18,7 @@ package trie
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
@@ -25,8 +26,11 @@ import (
 	"math/rand"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/ethereum/go-ethereum/common"
@@ -57,6 +61,28 @@ func TestEmptyTrie(t *testing.T) {
 	}
 }
 
+func TestIsEmpty(t *testing.T) {
+	trie := newEmpty()
+	if !trie.IsEmpty() {
+		t.Errorf("fresh trie not empty")
+	}
+	trie.Update([]byte("foo"), []byte("bar"))
+	if trie.IsEmpty() {
+		t.Errorf("trie with an entry empty")
+	}
+	trie.Delete([]byte("foo"))
+	if !trie.IsEmpty() {
+		t.Errorf("trie with all entries deleted not empty")
+	}
+	trie, _ = New(emptyRoot, NewDatabase(memorydb.New()))
+	if !trie.IsEmpty() {
+		t.Errorf("trie opened at the empty root not empty")
+	}
+	if it := trie.NodeIterator(nil); it.Next(true) {
+		t.Errorf("iterator yielded node on empty trie: path %x", it.Path())
+	}
+}
+
 func TestNull(t *testing.T) {
 	var trie Trie
 	key := make([]byte, 32)
@@ -152,6 +178,192 @@ func testMissingNode(t *testing.T, memonly bool) {
 	}
 }
 
+func TestMissingNodePrefix(t *testing.T) {
+	diskdb := memorydb.New()
+	triedb := NewDatabase(diskdb)
+
+	owner := crypto.Keccak256([]byte("contract"))
+	trie, _ := NewSecureWithPrefix(common.Hash{}, owner, triedb)
+	for i := byte(0); i < 16; i++ {
+		trie.Update([]byte{i}, bytes.Repeat([]byte{i}, 32))
+	}
+	root, _ := trie.Commit(nil)
+	triedb.Commit(root, false)
+
+	// Drop every node except the root and try to read through the trie
+	it := diskdb.NewIterator()
+	for it.Next() {
+		if !bytes.Equal(it.Key(), root[:]) {
+			diskdb.Delete(it.Key())
+		}
+	}
+	it.Release()
+
+	trie, _ = NewSecureWithPrefix(root, owner, NewDatabase(diskdb))
+	_, err := trie.TryGet([]byte{1})
+	missing, ok := err.(*MissingNodeError)
+	if !ok {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if !bytes.Equal(missing.Prefix, owner) {
+		t.Errorf("prefix mismatch: have %x, want %x", missing.Prefix, owner)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("%x", owner)) {
+		t.Errorf("error message misses prefix: %v", err)
+	}
+}
+
+func TestEmbeddedNodeReferenced(t *testing.T) {
+	diskdb := memorydb.New()
+	triedb := NewDatabase(diskdb)
+
+	// Store a leaf small enough to be embedded as a standalone node
+	leaf := &shortNode{Key: hexToCompact([]byte{2, 16}), Val: valueNode("v")}
+	enc, _ := rlp.EncodeToBytes(leaf)
+	if len(enc) >= hashLen {
+		t.Fatalf("leaf not embeddable: %d bytes", len(enc))
+	}
+	hash := crypto.Keccak256(enc)
+	diskdb.Put(hash, enc)
+
+	// Reference it by hash from a parent node
+	root := &fullNode{flags: nodeFlag{dirty: true}}
+	root.Children[1] = hashNode(hash)
+	root.Children[2] = valueNode("w")
+	trie := &Trie{db: triedb, root: root}
+
+	if _, err := trie.TryGet([]byte{0x12}); err != ErrEmbeddedNodeReferenced {
+		t.Errorf("wrong error: have %v, want %v", err, ErrEmbeddedNodeReferenced)
+	}
+	// A small root is always referenced by hash and must resolve fine
+	if _, err := New(common.BytesToHash(hash), triedb); err != nil {
+		t.Errorf("failed to open trie with small root: %v", err)
+	}
+}
+
+func TestConcurrentTrie(t *testing.T) {
+	triedb := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, triedb)
+	for i := 0; i < 256; i++ {
+		trie.Update(crypto.Keccak256([]byte{byte(i)}), []byte{byte(i)})
+	}
+	root, _ := trie.Commit(nil)
+	trie, _ = New(root, triedb)
+
+	ctrie := NewConcurrent(trie)
+	done := make(chan struct{})
+
+	var pend sync.WaitGroup
+	pend.Add(100)
+	for i := 0; i < 100; i++ {
+		go func(i int) {
+			defer pend.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := crypto.Keccak256([]byte{byte(i)})
+				val, err := ctrie.TryGet(key)
+				if err != nil {
+					t.Errorf("reader %d: failed to get key: %v", i, err)
+					return
+				}
+				if len(val) != 1 && len(val) != 2 {
+					t.Errorf("reader %d: unexpected value %x", i, val)
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 256; i++ {
+		if err := ctrie.TryUpdate(crypto.Keccak256([]byte{byte(i)}), []byte{byte(i), 1}); err != nil {
+			t.Fatalf("failed to update key: %v", err)
+		}
+	}
+	close(done)
+	pend.Wait()
+
+	for i := 0; i < 256; i++ {
+		if val := ctrie.Get(crypto.Keccak256([]byte{byte(i)})); !bytes.Equal(val, []byte{byte(i), 1}) {
+			t.Errorf("value mismatch for key %d: have %x, want %x", i, val, []byte{byte(i), 1})
+		}
+	}
+}
+
+// Tests that committing an account trie reports every account leaf along with
+// its parent node, so the referenced storage tries can be tracked.
+func TestCommitLeafCallback(t *testing.T) {
+	type account struct {
+		Nonce    uint64
+		Balance  *big.Int
+		Root     common.Hash
+		CodeHash []byte
+	}
+	trie, _ := New(common.Hash{}, NewDatabase(memorydb.New()))
+
+	roots := make(map[common.Hash]bool)
+	for i := 0; i < 100; i++ {
+		root := crypto.Keccak256Hash([]byte{byte(i)})
+		enc, _ := rlp.EncodeToBytes(&account{Nonce: uint64(i), Balance: big.NewInt(int64(i)), Root: root, CodeHash: crypto.Keccak256(nil)})
+		trie.Update(crypto.Keccak256([]byte{byte(i), 0x01}), enc)
+		roots[root] = true
+	}
+	trie.Commit(func(leaf []byte, parent common.Hash) error {
+		var acc account
+		if err := rlp.DecodeBytes(leaf, &acc); err != nil {
+			t.Fatalf("failed to decode leaf: %v", err)
+		}
+		if !roots[acc.Root] {
+			t.Errorf("unknown or duplicate storage root %x", acc.Root)
+		}
+		if parent == (common.Hash{}) {
+			t.Errorf("leaf %x without parent", acc.Root)
+		}
+		delete(roots, acc.Root)
+		return nil
+	})
+	if len(roots) != 0 {
+		t.Errorf("%d storage roots not reported", len(roots))
+	}
+}
+
+func TestCommitHook(t *testing.T) {
+	triedb := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, triedb)
+
+	committed := make(map[common.Hash][]byte)
+	trie.SetCommitHook(func(hash common.Hash, blob []byte) {
+		committed[hash] = common.CopyBytes(blob)
+	})
+	for i := 0; i < 100; i++ {
+		trie.Update(crypto.Keccak256([]byte{byte(i)}), bytes.Repeat([]byte{byte(i)}, 32))
+	}
+	root, err := trie.Commit(nil)
+	if err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	if _, ok := committed[root]; !ok {
+		t.Errorf("root node %x not reported", root)
+	}
+	for hash, blob := range committed {
+		if have := crypto.Keccak256Hash(blob); have != hash {
+			t.Errorf("node %x reported with mismatching blob hash %x", hash, have)
+		}
+	}
+	if nodes := triedb.Nodes(); len(nodes) != len(committed) {
+		t.Errorf("reported node count mismatch: have %d, want %d", len(committed), len(nodes))
+	}
+	// Committing a single update must only report the nodes along its path
+	committed = make(map[common.Hash][]byte)
+	trie.Update(crypto.Keccak256([]byte{0}), []byte("updated"))
+	trie.Commit(nil)
+	if len(committed) == 0 || len(committed) > 8 {
+		t.Errorf("unexpected number of nodes reported for single update: %d", len(committed))
+	}
+}
+
 func TestInsert(t *testing.T) {
 	trie := newEmpty()
 
@@ -229,6 +441,368 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestUpdateInMemory(t *testing.T) {
+	diskdb := &countingDB{KeyValueStore: memorydb.New(), gets: make(map[string]int)}
+	triedb := NewDatabase(diskdb)
+
+	trie, _ := New(common.Hash{}, triedb)
+	for i := byte(0); i < 16; i++ {
+		trie.Update(common.LeftPadBytes([]byte{i << 4}, 32), bytes.Repeat([]byte{i}, 32))
+	}
+	root, _ := trie.Commit(nil)
+	triedb.Commit(root, false)
+
+	// A bare hash root can't be updated without resolution
+	trie = &Trie{db: NewDatabase(diskdb), root: hashNode(root[:])}
+	key := common.LeftPadBytes([]byte{0x10}, 32)
+	if trie.UpdateInMemory(key, []byte("updated")) {
+		t.Fatalf("in-memory update succeeded on unresolved root")
+	}
+	if _, ok := trie.root.(hashNode); !ok {
+		t.Fatalf("failed in-memory update mutated the trie")
+	}
+	// Once the path is loaded, updates must not touch the database
+	if _, err := trie.TryGet(key); err != nil {
+		t.Fatalf("failed to resolve path: %v", err)
+	}
+	gets := len(diskdb.gets)
+	if !trie.UpdateInMemory(key, []byte("updated")) {
+		t.Fatalf("in-memory update failed on resident path")
+	}
+	if len(diskdb.gets) != gets {
+		t.Errorf("in-memory update accessed the database")
+	}
+	if v := trie.Get(key); !bytes.Equal(v, []byte("updated")) {
+		t.Errorf("value mismatch: have %q, want %q", v, "updated")
+	}
+	// Updates outside of the resident path must still be rejected
+	if trie.UpdateInMemory(common.LeftPadBytes([]byte{0x20}, 32), []byte("updated")) {
+		t.Errorf("in-memory update succeeded on unresolved path")
+	}
+}
+
+func TestUpdateBatch(t *testing.T) {
+	vals := []struct{ k, v string }{
+		{"do", "verb"},
+		{"ether", "wookiedoo"},
+		{"horse", "stallion"},
+		{"shaman", "horse"},
+		{"doge", "coin"},
+		{"ether", ""},
+		{"dog", "puppy"},
+		{"shaman", ""},
+	}
+	var keys, values [][]byte
+	for _, val := range vals {
+		keys = append(keys, []byte(val.k))
+		values = append(values, []byte(val.v))
+	}
+	trie := newEmpty()
+	if err := trie.TryUpdateBatch(keys, values); err != nil {
+		t.Fatalf("batch update failed: %v", err)
+	}
+	exp := common.HexToHash("5991bb8c6514148a29db676a14ac506cd2cd5775ace63c30a4fe457715e9ac84")
+	if hash := trie.Hash(); hash != exp {
+		t.Errorf("root mismatch: have %x, want %x", hash, exp)
+	}
+	if err := trie.TryUpdateBatch(keys, values[1:]); err == nil {
+		t.Errorf("mismatched batch accepted")
+	}
+}
+
+func TestUpdateBatchAtomic(t *testing.T) {
+	diskdb := memorydb.New()
+	triedb := NewDatabase(diskdb)
+
+	trie, _ := New(common.Hash{}, triedb)
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = crypto.Keccak256([]byte{byte(i)})
+		trie.Update(keys[i], keys[i])
+	}
+	root, _ := trie.Commit(nil)
+	triedb.Commit(root, false)
+
+	// Drop the subtrie of a key from a different branch than the first one
+	trie, _ = New(root, NewDatabase(diskdb))
+	branch := trie.root.(*fullNode)
+	missing := 1
+	for keys[missing][0]>>4 == keys[0][0]>>4 {
+		missing++
+	}
+	diskdb.Delete(branch.Children[keys[missing][0]>>4].(hashNode))
+
+	// The update of the first key succeeds, but must be rolled back
+	err := trie.TryUpdateBatch([][]byte{keys[0], keys[missing]}, [][]byte{[]byte("a"), []byte("b")})
+	if _, ok := err.(*MissingNodeError); !ok {
+		t.Fatalf("expected missing node error, have %v", err)
+	}
+	if trie.root != node(branch) {
+		t.Errorf("root modified by failed batch")
+	}
+	if hash := trie.Hash(); hash != root {
+		t.Errorf("root hash mismatch: have %x, want %x", hash, root)
+	}
+	if have := trie.Get(keys[0]); !bytes.Equal(have, keys[0]) {
+		t.Errorf("value modified by failed batch: have %x, want %x", have, keys[0])
+	}
+}
+
+func TestEmbeddedStats(t *testing.T) {
+	triedb := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, triedb)
+
+	// Two tiny leaves, both embedded into a branch which is embedded itself
+	trie.Update([]byte("a"), []byte("x"))
+	trie.Update([]byte("b"), []byte("y"))
+	if embedded, referenced, err := trie.EmbeddedStats(); err != nil {
+		t.Fatalf("failed to gather stats: %v", err)
+	} else if embedded != 3 || referenced != 0 {
+		t.Errorf("stats mismatch: have %d/%d, want 3/0", embedded, referenced)
+	}
+	// A large leaf is stored by hash and pushes its branch over the limit too
+	trie.Update([]byte("c"), bytes.Repeat([]byte{'z'}, 40))
+	root, _ := trie.Commit(nil)
+
+	trie, _ = New(root, triedb)
+	if embedded, referenced, err := trie.EmbeddedStats(); err != nil {
+		t.Fatalf("failed to gather stats: %v", err)
+	} else if embedded != 2 || referenced != 2 {
+		t.Errorf("stats mismatch: have %d/%d, want 2/2", embedded, referenced)
+	}
+}
+
+func TestContainsHash(t *testing.T) {
+	triedb := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, triedb)
+	for i := 0; i < 100; i++ {
+		trie.Update(crypto.Keccak256([]byte{byte(i)}), bytes.Repeat([]byte{byte(i)}, 32))
+	}
+	root, _ := trie.Commit(nil)
+
+	// Pick an internal node and look it up on a freshly loaded trie
+	var (
+		want common.Hash
+		path []byte
+	)
+	for it := trie.NodeIterator(nil); it.Next(true); {
+		if len(it.Path()) == 1 && it.Hash() != (common.Hash{}) {
+			want, path = it.Hash(), common.CopyBytes(it.Path())
+			break
+		}
+	}
+	trie, _ = New(root, triedb)
+	if found, have, err := trie.ContainsHash(want); err != nil || !found {
+		t.Fatalf("node %x not found: %v", want, err)
+	} else if !bytes.Equal(have, path) {
+		t.Errorf("path mismatch: have %x, want %x", have, path)
+	}
+	if found, have, err := trie.ContainsHash(root); err != nil || !found || len(have) != 0 {
+		t.Errorf("root lookup mismatch: found %v, path %x, err %v", found, have, err)
+	}
+	if found, _, err := trie.ContainsHash(common.HexToHash("0xdeadbeef")); err != nil || found {
+		t.Errorf("unrelated hash found: %v", err)
+	}
+	if found, have, err := trie.ContainsHash(common.Hash{}); err != nil || found {
+		t.Errorf("zero hash found at %x: %v", have, err)
+	}
+}
+
+func TestUpdateInfo(t *testing.T) {
+	trie := newEmpty()
+	tests := []struct {
+		key, value           string
+		changed, restructure bool
+	}{
+		{"doe", "reindeer", true, true},   // insert into empty trie
+		{"doe", "reindeer", false, false}, // same value again
+		{"doe", "deer", true, false},      // replace existing leaf value
+		{"dog", "puppy", true, true},      // split the short node
+		{"dogglesworth", "cat", true, true},
+		{"do", "verb", true, true},       // fill the value slot of a branch
+		{"do", "act", true, false},       // replace a branch value
+		{"dogglesworth", "", true, true}, // delete existing key
+		{"cat", "", false, false},        // delete missing key
+	}
+	for i, tt := range tests {
+		changed, restructured, err := trie.TryUpdateInfo([]byte(tt.key), []byte(tt.value))
+		if err != nil {
+			t.Fatalf("test %d: update failed: %v", i, err)
+		}
+		if changed != tt.changed || restructured != tt.restructure {
+			t.Errorf("test %d: have changed %v, restructured %v; want %v, %v", i, changed, restructured, tt.changed, tt.restructure)
+		}
+	}
+	if have := string(trie.Get([]byte("doe"))); have != "deer" {
+		t.Errorf("value mismatch: have %q, want %q", have, "deer")
+	}
+}
+
+func TestDeleteInvalidLeaf(t *testing.T) {
+	// A leaf key pointing to a branch instead of a value must not panic
+	leaf := &shortNode{Key: []byte{1, 16}, Val: valueNode("v")}
+	root := &shortNode{Key: []byte{1, 0, 16}, Val: &fullNode{Children: [17]node{leaf, leaf}}}
+	trie := &Trie{db: NewDatabase(memorydb.New()), root: root}
+
+	if _, _, err := trie.DeleteAndGet([]byte{0x10}); err == nil {
+		t.Errorf("delete of invalid leaf succeeded")
+	}
+	if trie.root != node(root) {
+		t.Errorf("trie modified by failed delete")
+	}
+}
+
+func TestCountNodesByType(t *testing.T) {
+	triedb := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, triedb)
+
+	// short(6 1) -> full{6: full{1: short(value), 2: short(value)}, 16: value}
+	updateString(trie, "a", "root")
+	updateString(trie, "aa", strings.Repeat("x", 40))
+	updateString(trie, "ab", strings.Repeat("y", 40))
+
+	want := map[string]int{"short": 3, "full": 2, "value": 3}
+	if have := trie.CountNodesByType(); !reflect.DeepEqual(have, want) {
+		t.Errorf("counts mismatch: have %v, want %v", have, want)
+	}
+	// Reloading from the database leaves only the root resolved
+	root, _ := trie.Commit(nil)
+	trie, _ = New(root, triedb)
+
+	want = map[string]int{"short": 1, "hash": 1}
+	if have := trie.CountNodesByType(); !reflect.DeepEqual(have, want) {
+		t.Errorf("counts mismatch after reload: have %v, want %v", have, want)
+	}
+}
+
+func TestEstimateMemory(t *testing.T) {
+	trie := newEmpty()
+	if size := trie.EstimateMemory(); size != 0 {
+		t.Errorf("empty trie size mismatch: have %d, want 0", size)
+	}
+	prev := 0
+	for i := 0; i < 100; i++ {
+		trie.Update(crypto.Keccak256([]byte{byte(i)}), bytes.Repeat([]byte{byte(i)}, 32))
+		size := trie.EstimateMemory()
+		if size <= prev {
+			t.Fatalf("size not growing after insert %d: have %d, previous %d", i, size, prev)
+		}
+		prev = size
+	}
+	// Hashing caches the node hashes, which take up memory too
+	trie.Hash()
+	if size := trie.EstimateMemory(); size <= prev {
+		t.Errorf("size not growing after hashing: have %d, previous %d", size, prev)
+	}
+}
+
+func TestHashFactory(t *testing.T) {
+	triedb := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, triedb)
+	trie.SetHashFactory(sha256.New)
+
+	if have, want := trie.Hash(), common.Hash(sha256.Sum256(emptyStringRLP)); have != want {
+		t.Errorf("empty root mismatch: have %x, want %x", have, want)
+	}
+	// Roots must differ from Keccak, but be consistent across insertion orders
+	keccak, reversed := newEmpty(), newEmpty()
+	reversed.SetHashFactory(sha256.New)
+	for i := 0; i < 100; i++ {
+		trie.Update([]byte{byte(i)}, bytes.Repeat([]byte{byte(i)}, 32))
+		keccak.Update([]byte{byte(i)}, bytes.Repeat([]byte{byte(i)}, 32))
+		reversed.Update([]byte{byte(99 - i)}, bytes.Repeat([]byte{byte(99 - i)}, 32))
+	}
+	root := trie.Hash()
+	if root == keccak.Hash() {
+		t.Errorf("custom hash yields the Keccak root")
+	}
+	if have := reversed.Hash(); have != root {
+		t.Errorf("root mismatch across insertion orders: have %x, want %x", have, root)
+	}
+	// Committed nodes must be retrievable by their custom hashes
+	if committed, _ := trie.Commit(nil); committed != root {
+		t.Errorf("commit root mismatch: have %x, want %x", committed, root)
+	}
+	if err := trie.Prove([]byte{0}, 0, memorydb.New()); err == nil {
+		t.Errorf("proof of custom hashed trie created")
+	}
+	trie, _ = NewWithHashFactory(root, triedb, sha256.New)
+	for i := 0; i < 100; i++ {
+		if have := trie.Get([]byte{byte(i)}); !bytes.Equal(have, bytes.Repeat([]byte{byte(i)}, 32)) {
+			t.Fatalf("value %d mismatch: have %x", i, have)
+		}
+	}
+	trie.Update([]byte{0}, []byte{1})
+	reversed.Update([]byte{0}, []byte{1})
+	if have, want := trie.Hash(), reversed.Hash(); have != want {
+		t.Errorf("root mismatch after update: have %x, want %x", have, want)
+	}
+	// Committed empty tries must be reopened as empty
+	empty, _ := NewWithHashFactory(common.Hash{}, triedb, sha256.New)
+	root, _ = empty.Commit(nil)
+	if empty, err := NewWithHashFactory(root, triedb, sha256.New); err != nil {
+		t.Errorf("failed to reopen empty trie: %v", err)
+	} else if !empty.IsEmpty() {
+		t.Errorf("reopened empty trie not empty")
+	}
+}
+
+func TestHashStats(t *testing.T) {
+	trie := newEmpty()
+	for i := 0; i < 1000; i++ {
+		trie.Update(crypto.Keccak256([]byte{byte(i), byte(i >> 8)}), bytes.Repeat([]byte{byte(i)}, 32))
+	}
+	trie.Hash()
+	if stats := trie.HashStats(); stats.Computed == 0 || stats.Cached != 0 {
+		t.Errorf("initial hashing stats mismatch: %+v", stats)
+	}
+	trie.Hash()
+	if stats := trie.HashStats(); stats.Computed != 0 || stats.Cached != 1 {
+		t.Errorf("rehashing stats mismatch: %+v", stats)
+	}
+	// Updating a single leaf must only recompute the nodes on its path
+	key := crypto.Keccak256([]byte{42, 0})
+	trie.Update(key, []byte("updated"))
+	trie.Hash()
+
+	proof := memorydb.New()
+	trie.Prove(key, 0, proof)
+	if stats := trie.HashStats(); stats.Computed != proof.Len() {
+		t.Errorf("recomputed nodes mismatch: have %d, want %d", stats.Computed, proof.Len())
+	}
+}
+
+func TestDeleteAndGet(t *testing.T) {
+	trie := newEmpty()
+	updateString(trie, "doe", "reindeer")
+	updateString(trie, "dog", "puppy")
+	updateString(trie, "dogglesworth", "cat")
+	trie.Commit(nil)
+
+	old, existed, err := trie.DeleteAndGet([]byte("dog"))
+	if err != nil {
+		t.Fatalf("failed to delete present key: %v", err)
+	}
+	if !existed || !bytes.Equal(old, []byte("puppy")) {
+		t.Errorf("present key mismatch: have %q/%v, want %q/%v", old, existed, "puppy", true)
+	}
+	if v := getString(trie, "dog"); v != nil {
+		t.Errorf("deleted key still present: %q", v)
+	}
+	root := trie.Hash()
+
+	old, existed, err = trie.DeleteAndGet([]byte("unknown"))
+	if err != nil {
+		t.Fatalf("failed to delete absent key: %v", err)
+	}
+	if existed || old != nil {
+		t.Errorf("absent key mismatch: have %q/%v, want nil/false", old, existed)
+	}
+	if hash := trie.Hash(); hash != root {
+		t.Errorf("root changed on absent delete: have %x, want %x", hash, root)
+	}
+}
+
 func TestEmptyValues(t *testing.T) {
 	trie := newEmpty()
 
@@ -317,6 +891,34 @@ func TestLargeValue(t *testing.T) {
 	trie.Hash()
 }
 
+func TestFreeze(t *testing.T) {
+	trie := newEmpty()
+	updateString(trie, "doe", "reindeer")
+	updateString(trie, "dog", "puppy")
+	root := trie.Hash()
+
+	trie.Freeze()
+	if !bytes.Equal(getString(trie, "dog"), []byte("puppy")) {
+		t.Errorf("frozen trie read mismatch: have %q, want %q", getString(trie, "dog"), "puppy")
+	}
+	if err := trie.TryUpdate([]byte("dog"), []byte("kitten")); err != ErrFrozen {
+		t.Errorf("update on frozen trie: have %v, want %v", err, ErrFrozen)
+	}
+	if err := trie.TryDelete([]byte("doe")); err != ErrFrozen {
+		t.Errorf("delete on frozen trie: have %v, want %v", err, ErrFrozen)
+	}
+	if hash := trie.Hash(); hash != root {
+		t.Errorf("frozen trie root changed: have %x, want %x", hash, root)
+	}
+	trie.Unfreeze()
+	if err := trie.TryUpdate([]byte("dog"), []byte("kitten")); err != nil {
+		t.Fatalf("update on unfrozen trie failed: %v", err)
+	}
+	if !bytes.Equal(getString(trie, "dog"), []byte("kitten")) {
+		t.Errorf("unfrozen trie read mismatch: have %q, want %q", getString(trie, "dog"), "kitten")
+	}
+}
+
 type countingDB struct {
 	ethdb.KeyValueStore
 	gets map[string]int
@@ -327,6 +929,52 @@ func (db *countingDB) Get(key []byte) ([]byte, error) {
 	return db.KeyValueStore.Get(key)
 }
 
+// slowDB is a key-value store delaying every read by a fixed latency.
+type slowDB struct {
+	ethdb.KeyValueStore
+	delay time.Duration
+}
+
+func (db *slowDB) Get(key []byte) ([]byte, error) {
+	time.Sleep(db.delay)
+	return db.KeyValueStore.Get(key)
+}
+
+func TestResolveLatency(t *testing.T) {
+	diskdb := &slowDB{KeyValueStore: memorydb.New()}
+	triedb := NewDatabase(diskdb)
+
+	trie, _ := New(common.Hash{}, triedb)
+	for i := 0; i < 100; i++ {
+		trie.Update(crypto.Keccak256([]byte{byte(i)}), bytes.Repeat([]byte{byte(i)}, 32))
+	}
+	root, _ := trie.Commit(nil)
+	triedb.Commit(root, false)
+
+	diskdb.delay = 5 * time.Millisecond
+	trie, _ = New(root, NewDatabase(diskdb))
+	trie.SetResolveTiming(true)
+	for i := 0; i < 3; i++ {
+		trie.Get(crypto.Keccak256([]byte{byte(i)}))
+	}
+	stats := trie.ResolveLatency()
+	if stats.Count == 0 {
+		t.Fatalf("no resolutions recorded")
+	}
+	if stats.Max < diskdb.delay {
+		t.Errorf("max latency too low: have %v, want >= %v", stats.Max, diskdb.delay)
+	}
+	if min := time.Duration(stats.Count) * diskdb.delay; stats.Total < min {
+		t.Errorf("total latency too low: have %v, want >= %v", stats.Total, min)
+	}
+	// Disabling timing must stop the collection
+	trie.SetResolveTiming(false)
+	trie.Get(crypto.Keccak256([]byte{byte(50)}))
+	if have := trie.ResolveLatency(); have != stats {
+		t.Errorf("stats changed with timing disabled: have %+v, want %+v", have, stats)
+	}
+}
+
 // randTest performs random trie operations.
 // Instances of this test are created by Generate.
 type randTest []randTestStep
@@ -442,6 +1090,61 @@ func TestRandom(t *testing.T) {
 	}
 }
 
+func TestHashParallel(t *testing.T) {
+	check := func(keys, vals [][]byte, workers uint8) bool {
+		serial, parallel := newEmpty(), newEmpty()
+		for i, key := range keys {
+			val := []byte{byte(i) + 1}
+			if i < len(vals) && len(vals[i]) > 0 {
+				val = vals[i]
+			}
+			serial.Update(key, val)
+			parallel.Update(key, val)
+		}
+		return serial.Hash() == parallel.HashParallel(int(workers%8)+1)
+	}
+	if err := quick.Check(check, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Hashing again after an update must only rehash the dirty paths
+	trie, fresh := newEmpty(), newEmpty()
+	for i := 0; i < 1000; i++ {
+		key := crypto.Keccak256([]byte{byte(i), byte(i >> 8)})
+		trie.Update(key, []byte{byte(i) + 1})
+		fresh.Update(key, []byte{byte(i) + 1})
+	}
+	trie.HashParallel(4)
+	trie.Update([]byte("foo"), []byte("bar"))
+	fresh.Update([]byte("foo"), []byte("bar"))
+	if have, want := trie.HashParallel(4), fresh.Hash(); have != want {
+		t.Errorf("root mismatch after update: have %x, want %x", have, want)
+	}
+	// Parallel hashing must record the same statistics as serial hashing
+	fresh.Update([]byte("bar"), []byte("baz"))
+	trie.Update([]byte("bar"), []byte("baz"))
+	fresh.Hash()
+	trie.HashParallel(4)
+	if have, want := trie.HashStats(), fresh.HashStats(); have != want {
+		t.Errorf("hash stats mismatch: have %+v, want %+v", have, want)
+	}
+	// Branches below a top level extension must be hashed in parallel too
+	trie, fresh = newEmpty(), newEmpty()
+	for i := 0; i < 1000; i++ {
+		key := append([]byte("prefix"), crypto.Keccak256([]byte{byte(i), byte(i >> 8)})...)
+		trie.Update(key, []byte{byte(i) + 1})
+		fresh.Update(key, []byte{byte(i) + 1})
+	}
+	if _, ok := trie.root.(*shortNode); !ok {
+		t.Fatalf("root is not an extension: %T", trie.root)
+	}
+	if have, want := trie.HashParallel(4), fresh.Hash(); have != want {
+		t.Errorf("extension root mismatch: have %x, want %x", have, want)
+	}
+	if have, want := trie.HashStats(), fresh.HashStats(); have != want {
+		t.Errorf("extension hash stats mismatch: have %+v, want %+v", have, want)
+	}
+}
+
 func BenchmarkGet(b *testing.B)      { benchGet(b, false) }
 func BenchmarkGetDB(b *testing.B)    { benchGet(b, true) }
 func BenchmarkUpdateBE(b *testing.B) { benchUpdate(b, binary.BigEndian) }
@@ -488,6 +1191,20 @@ func benchUpdate(b *testing.B, e binary.ByteOrder) *Trie {
 	return trie
 }
 
+func BenchmarkUpdateBatch(b *testing.B) {
+	keys, values := make([][]byte, 10000), make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = crypto.Keccak256([]byte(fmt.Sprintf("key-%d", i)))
+		values[i] = keys[i][:20]
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie := new(Trie)
+		trie.TryUpdateBatch(keys, values)
+		trie.Hash()
+	}
+}
+
 // Benchmarks the trie hashing. Since the trie caches the result of any operation,
 // we cannot use b.N as the number of hashing rouns, since all rounds apart from
 // the first one will be NOOP. As such, we'll use b.N as the number of account to